@@ -1,16 +1,41 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
+
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad-autoscaler/plugins"
 	"github.com/jorgemarey/nomad-nova-autoscaler/plugin"
 )
 
+// factories holds all the plugins this binary is able to serve.
+var factories = map[string]plugins.PluginFactory{
+	"os-nova":     plugin.PluginConfig.Factory,
+	"os-octavia":  plugin.OctaviaPluginConfig.Factory,
+	"os-capacity": plugin.CapacityPluginConfig.Factory,
+}
+
 func main() {
 	plugins.Serve(factory)
 }
 
-// factory returns a new instance of the Google Cloud Engine MIG plugin.
+// factory returns a new instance of the selected plugin. The plugin is chosen
+// by the first argument (set using the plugin `args`) or by the binary name,
+// defaulting to the OS Nova target plugin.
 func factory(log hclog.Logger) interface{} {
-	return plugin.NewOSNovaPlugin(log)
+	for _, name := range selectors() {
+		if f, ok := factories[name]; ok {
+			return f(log)
+		}
+	}
+	return factories["os-nova"](log)
+}
+
+func selectors() []string {
+	names := []string{}
+	if len(os.Args) > 1 {
+		names = append(names, os.Args[1])
+	}
+	return append(names, filepath.Base(os.Args[0]))
 }
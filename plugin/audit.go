@@ -0,0 +1,232 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+const (
+	configKeyAuditLog = "audit_log" // a file path or stdout
+
+	auditLogStdout = "stdout"
+)
+
+// auditLog writes a JSON line per scaling action.
+type auditLog struct {
+	lock   sync.Mutex
+	writer io.Writer
+	closer io.Closer
+}
+
+// newAuditLog opens the audit log set in the config. It returns nil if none is
+// set.
+func newAuditLog(config map[string]string) (*auditLog, error) {
+	path := config[configKeyAuditLog]
+	switch path {
+	case "":
+		return nil, nil
+	case auditLogStdout:
+		return &auditLog{writer: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", configKeyAuditLog, err)
+	}
+	return &auditLog{writer: f, closer: f}, nil
+}
+
+func (a *auditLog) write(record *auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, err = a.writer.Write(append(line, '\n'))
+	return err
+}
+
+func (a *auditLog) close() {
+	if a != nil && a.closer != nil {
+		a.closer.Close()
+	}
+}
+
+// writeAudit finishes the record of the scaling action and writes it.
+func (t *TargetPlugin) writeAudit(record *auditRecord, err error) {
+	record.finish(err)
+	if err := t.audit.write(record); err != nil {
+		t.logger.Error("failed to write audit record", "error", err)
+	}
+}
+
+// auditPool returns the name of the pool, stack or cluster of the policy
+// target.
+func auditPool(config map[string]string) string {
+	for _, key := range []string{configKeyPoolName, configKeyStackName, configKeySenlinCluster, configKeyMagnumCluster} {
+		if v := config[key]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// auditRecord is the record of a scaling action. The servers created and
+// deleted are added while the action runs.
+type auditRecord struct {
+	lock sync.Mutex
+
+	Time            time.Time     `json:"time"`
+	Mode            string        `json:"mode"`
+	Pool            string        `json:"pool"`
+	Direction       string        `json:"direction"`
+	Reason          string        `json:"reason"`
+	RequestedCount  int64         `json:"requested_count"`
+	PreviousCount   *int64        `json:"previous_count,omitempty"`
+	ActualCount     *int64        `json:"actual_count,omitempty"`
+	Created         []auditServer `json:"created,omitempty"`
+	Deleted         []auditServer `json:"deleted,omitempty"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Error           string        `json:"error,omitempty"`
+}
+
+type auditServer struct {
+	ID              string  `json:"id"`
+	Name            string  `json:"name,omitempty"`
+	AZ              string  `json:"availability_zone,omitempty"`
+	ImageID         string  `json:"image_id,omitempty"`
+	FlavorID        string  `json:"flavor_id,omitempty"`
+	FlavorName      string  `json:"flavor_name,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+func newAuditRecord(mode, pool string, action sdk.ScalingAction) *auditRecord {
+	return &auditRecord{
+		Time:           time.Now().UTC(),
+		Mode:           mode,
+		Pool:           pool,
+		Direction:      action.Direction.String(),
+		Reason:         action.Reason,
+		RequestedCount: action.Count,
+	}
+}
+
+type auditRecordKey struct{}
+
+func withAuditRecord(ctx context.Context, record *auditRecord) context.Context {
+	return context.WithValue(ctx, auditRecordKey{}, record)
+}
+
+// auditFromContext returns the record of the scaling action in progress, or
+// nil if the action isn't audited. The record methods can be called on nil.
+func auditFromContext(ctx context.Context) *auditRecord {
+	record, _ := ctx.Value(auditRecordKey{}).(*auditRecord)
+	return record
+}
+
+// addCount adds the servers the pool had before the action, as pools spanning
+// several regions are counted in each of them.
+func (r *auditRecord) addCount(count int64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.PreviousCount == nil {
+		r.PreviousCount = new(int64)
+	}
+	*r.PreviousCount += count
+}
+
+func (r *auditRecord) created(server auditServer) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Created = append(r.Created, server)
+}
+
+func (r *auditRecord) deleted(server auditServer) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Deleted = append(r.Deleted, server)
+}
+
+// finish sets the result of the action.
+func (r *auditRecord) finish(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.DurationSeconds = time.Since(r.Time).Seconds()
+	if r.PreviousCount != nil {
+		actual := *r.PreviousCount + int64(len(r.Created)) - int64(len(r.Deleted))
+		r.ActualCount = &actual
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// auditScaleOut runs a scale-out of a mode where the service creates the
+// servers, recording the new ones by listing the servers before and after it,
+// even if it fails as some can be created. The servers can't be recorded if the
+// list fails, but the scale-out goes on.
+func (t *TargetPlugin) auditScaleOut(ctx context.Context, list func() ([]string, error), scaleOut func() error) error {
+	record := auditFromContext(ctx)
+	if record == nil {
+		return scaleOut()
+	}
+	before, err := list()
+	if err != nil {
+		t.logger.Warn("failed to list the servers, the created ones aren't audited", "error", err)
+		return scaleOut()
+	}
+	scaleErr := scaleOut()
+	after, err := list()
+	if err != nil {
+		t.logger.Warn("failed to list the servers, the created ones aren't audited", "error", err)
+		return scaleErr
+	}
+
+	existing := make(map[string]struct{}, len(before))
+	for _, id := range before {
+		existing[id] = struct{}{}
+	}
+	for _, id := range after {
+		if _, ok := existing[id]; !ok {
+			record.created(auditServer{ID: id})
+		}
+	}
+	return scaleErr
+}
+
+// newAuditServer returns the record of an existing server. Since the compute
+// microversion 2.47 the server only has the name of its flavor.
+func newAuditServer(server *servers.Server) auditServer {
+	flavorName, _ := server.Flavor["original_name"].(string)
+	return auditServer{
+		ID:         server.ID,
+		Name:       server.Name,
+		AZ:         server.AvailabilityZone,
+		ImageID:    refID(server.Image),
+		FlavorID:   refID(server.Flavor),
+		FlavorName: flavorName,
+	}
+}
+
+// refID returns the ID of the image or flavor a server refers to.
+func refID(ref map[string]any) string {
+	id, _ := ref["id"].(string)
+	return id
+}
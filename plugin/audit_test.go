@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLog(map[string]string{"audit_log": path})
+	assert.NoError(t, err)
+	defer audit.close()
+
+	action := sdk.ScalingAction{Count: 3, Direction: sdk.ScaleDirectionUp, Reason: "scaling up because factor is 1.5"}
+	record := newAuditRecord(modeServers, "workers", action)
+	ctx := withAuditRecord(context.Background(), record)
+	auditFromContext(ctx).addCount(1)
+	auditFromContext(ctx).created(auditServer{ID: "abc", Name: "worker-1", AZ: "az1", ImageID: "img", FlavorID: "flv"})
+	record.finish(fmt.Errorf("quota exceeded"))
+	assert.NoError(t, audit.write(record))
+
+	// not audited actions don't fail
+	auditFromContext(context.Background()).created(auditServer{ID: "def"})
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 1)
+
+	var written map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &written))
+	assert.Equal(t, "workers", written["pool"])
+	assert.Equal(t, "up", written["direction"])
+	assert.Equal(t, "scaling up because factor is 1.5", written["reason"])
+	assert.Equal(t, float64(3), written["requested_count"])
+	assert.Equal(t, float64(1), written["previous_count"])
+	assert.Equal(t, float64(2), written["actual_count"])
+	assert.Equal(t, "quota exceeded", written["error"])
+	assert.Len(t, written["created"], 1)
+	assert.NotContains(t, written, "deleted")
+
+	audit, err = newAuditLog(map[string]string{})
+	assert.NoError(t, err)
+	assert.Nil(t, audit)
+}
+
+func Test_ScaleAuditsFailedClients(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLog(map[string]string{"audit_log": path})
+	assert.NoError(t, err)
+	defer audit.close()
+
+	p := &TargetPlugin{
+		logger:       hclog.NewNullLogger(),
+		config:       map[string]string{},
+		scaleTimeout: time.Minute,
+		clients:      newClientsCache(),
+		audit:        audit,
+	}
+	// the clients of the project can't be set up without credentials
+	action := sdk.ScalingAction{Count: 3, Direction: sdk.ScaleDirectionUp}
+	err = p.Scale(action, map[string]string{configKeyPoolName: "workers", configKeyProjectID: "p1"})
+	assert.Error(t, err)
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	var written map[string]any
+	assert.NoError(t, json.Unmarshal(content, &written))
+	assert.Equal(t, "workers", written["pool"])
+	assert.Contains(t, written["error"], "failed to set up the clients of the policy target")
+}
+
+func Test_AuditScaleOut(t *testing.T) {
+	testCases := []struct {
+		name            string
+		after           []string
+		listErr         error
+		scaleErr        error
+		expectedCreated []auditServer
+	}{
+		{
+			name:            "scaled out",
+			after:           []string{"srv-1", "srv-2", "srv-3"},
+			expectedCreated: []auditServer{{ID: "srv-2"}, {ID: "srv-3"}},
+		},
+		{
+			name:            "partial scale-out",
+			after:           []string{"srv-1", "srv-2"},
+			scaleErr:        fmt.Errorf("quota exceeded"),
+			expectedCreated: []auditServer{{ID: "srv-2"}},
+		},
+		{
+			name:     "failed scale-out",
+			after:    []string{"srv-1"},
+			scaleErr: fmt.Errorf("quota exceeded"),
+		},
+		{
+			name:    "failed list",
+			listErr: fmt.Errorf("unavailable"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			plugin := &TargetPlugin{logger: hclog.NewNullLogger()}
+			record := newAuditRecord(modeHeat, "workers", sdk.ScalingAction{Count: 3})
+			ctx := withAuditRecord(context.Background(), record)
+
+			lists := 0
+			err := plugin.auditScaleOut(ctx, func() ([]string, error) {
+				lists++
+				if lists == 1 {
+					return []string{"srv-1"}, nil
+				}
+				return tc.after, tc.listErr
+			}, func() error {
+				return tc.scaleErr
+			})
+			assert.Equal(t, tc.scaleErr, err, tc.name)
+			assert.Equal(t, 2, lists, tc.name)
+			assert.Equal(t, tc.expectedCreated, record.Created, tc.name)
+		})
+	}
+}
+
+func Test_NewAuditServer(t *testing.T) {
+	server := &servers.Server{
+		ID:               "srv-1",
+		Name:             "worker-1",
+		AvailabilityZone: "az1",
+		Image:            map[string]any{"id": "img"},
+		Flavor:           map[string]any{"original_name": "t1.large", "vcpus": 4},
+	}
+	assert.Equal(t, auditServer{ID: "srv-1", Name: "worker-1", AZ: "az1", ImageID: "img", FlavorName: "t1.large"}, newAuditServer(server))
+
+	// before the compute microversion 2.47 the flavor has its ID
+	server.Flavor = map[string]any{"id": "flv"}
+	assert.Equal(t, "flv", newAuditServer(server).FlavorID)
+}
@@ -0,0 +1,292 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/gophercloud/v2/openstack/config/clouds"
+)
+
+const (
+	configKeyUserID            = "user_id"
+	configKeyUserDomainName    = "user_domain_name"
+	configKeyUserDomainID      = "user_domain_id"
+	configKeyProjectDomainName = "project_domain_name"
+	configKeyProjectDomainID   = "project_domain_id"
+	configKeyAppCredID         = "application_credential_id"
+	configKeyAppCredName       = "application_credential_name"
+	configKeyAppCredSecret     = "application_credential_secret"
+	configKeyToken             = "token"
+	configKeySystemScope       = "system_scope"
+	configKeyCloud             = "cloud"
+	configKeyCloudsFile        = "clouds_file"
+	configKeyInterface         = "interface"
+
+	// the endpoint settings of a service are set with <service>_<suffix>,
+	// e.g. compute_endpoint
+	endpointURLSuffix = "_endpoint"
+	serviceTypeSuffix = "_service_type"
+	serviceNameSuffix = "_service_name"
+	defaultRegionName = "RegionOne"
+)
+
+// cloudOptions holds the settings of a cloud loaded from clouds.yaml (and
+// secure.yaml).
+type cloudOptions struct {
+	auth     gophercloud.AuthOptions
+	endpoint gophercloud.EndpointOpts
+	tls      *tls.Config
+}
+
+// loadCloud loads the cloud selected in the config. It returns nil if no cloud
+// was selected.
+func loadCloud(config map[string]string) (*cloudOptions, error) {
+	name, ok := config[configKeyCloud]
+	if !ok || name == "" {
+		return nil, nil
+	}
+	opts := []clouds.ParseOption{clouds.WithCloudName(name)}
+	if path, ok := config[configKeyCloudsFile]; ok && path != "" {
+		opts = append(opts, clouds.WithLocations(path))
+	}
+	ao, eo, tlsConfig, err := clouds.Parse(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cloud %s: %v", name, err)
+	}
+	return &cloudOptions{auth: ao, endpoint: eo, tls: tlsConfig}, nil
+}
+
+// endpointOpts returns the options used to find the service endpoints. The
+// region and interface set in the config take precedence over the ones of the
+// cloud.
+func endpointOpts(config map[string]string, cloud *cloudOptions) (gophercloud.EndpointOpts, error) {
+	eo := gophercloud.EndpointOpts{Region: defaultRegionName}
+	if cloud != nil {
+		eo = cloud.endpoint
+		if eo.Region == "" {
+			eo.Region = defaultRegionName
+		}
+	}
+	if region, ok := config[configKeyRegionName]; ok {
+		eo.Region = region
+	}
+	if v, ok := config[configKeyInterface]; ok && v != "" {
+		switch availability := gophercloud.Availability(strings.TrimSuffix(v, "URL")); availability {
+		case gophercloud.AvailabilityPublic, gophercloud.AvailabilityInternal, gophercloud.AvailabilityAdmin:
+			eo.Availability = availability
+		default:
+			return eo, fmt.Errorf("invalid value for '%s': must be one of public, internal or admin", configKeyInterface)
+		}
+	}
+	return eo, nil
+}
+
+// newServiceClient creates the client of the service using the constructor,
+// applying the endpoint URL and the service type and name set in the config
+// for it.
+func newServiceClient(provider *gophercloud.ProviderClient, eo gophercloud.EndpointOpts, config map[string]string, service string,
+	newClient func(*gophercloud.ProviderClient, gophercloud.EndpointOpts) (*gophercloud.ServiceClient, error)) (*gophercloud.ServiceClient, error) {
+	if v := config[service+serviceTypeSuffix]; v != "" {
+		eo.Type = v
+	}
+	if v := config[service+serviceNameSuffix]; v != "" {
+		eo.Name = v
+	}
+
+	endpoint := config[service+endpointURLSuffix]
+	if endpoint == "" {
+		client, err := newClient(provider, eo)
+		if err != nil {
+			return nil, err
+		}
+		pluginMetrics.registerEndpoint(client.Endpoint, service)
+		return client, nil
+	}
+
+	// build the client with a copy of the provider that doesn't look for the
+	// endpoint in the catalog, and then make it use the actual provider
+	locator := *provider
+	locator.EndpointLocator = func(gophercloud.EndpointOpts) (string, error) {
+		return gophercloud.NormalizeURL(endpoint), nil
+	}
+	client, err := newClient(&locator, eo)
+	if err != nil {
+		return nil, err
+	}
+	client.ProviderClient = provider
+	pluginMetrics.registerEndpoint(client.Endpoint, service)
+	return client, nil
+}
+
+// authOptions builds the keystone authentication options from the cloud, or
+// the env vars if none was loaded, and the passed config mapping, the config
+// taking precedence.
+func authOptions(config map[string]string, cloud *cloudOptions) (gophercloud.AuthOptions, error) {
+	var ao gophercloud.AuthOptions
+	if cloud != nil {
+		ao = cloud.auth
+	} else {
+		// use env vars but don't fail if not all are provided
+		ao, _ = openstack.AuthOptionsFromEnv()
+	}
+
+	// a method selected in the config replaces the one set in the env or cloud
+	switch {
+	case hasAnyKey(config, configKeyAppCredID, configKeyAppCredName):
+		ao.Password, ao.TokenID = "", ""
+		ao.TenantID, ao.TenantName, ao.Scope = "", "", nil
+	case hasAnyKey(config, configKeyToken):
+		// the token already identifies the user, gophercloud refuses it along
+		// with a user
+		ao.Password, ao.ApplicationCredentialID, ao.ApplicationCredentialName = "", "", ""
+		ao.Username, ao.UserID, ao.DomainName, ao.DomainID = "", "", "", ""
+	case hasAnyKey(config, configKeyPassword):
+		ao.TokenID, ao.ApplicationCredentialID, ao.ApplicationCredentialName = "", "", ""
+	}
+
+	for key, field := range map[string]*string{
+		configKeyAuthUrl:       &ao.IdentityEndpoint,
+		configKeyUsername:      &ao.Username,
+		configKeyUserID:        &ao.UserID,
+		configKeyPassword:      &ao.Password,
+		configKeyProjectID:     &ao.TenantID,
+		configKeyProjectName:   &ao.TenantName,
+		configKeyAppCredID:     &ao.ApplicationCredentialID,
+		configKeyAppCredName:   &ao.ApplicationCredentialName,
+		configKeyAppCredSecret: &ao.ApplicationCredentialSecret,
+		configKeyToken:         &ao.TokenID,
+	} {
+		if v, ok := config[key]; ok {
+			*field = v
+		}
+	}
+
+	// domain_name is used for both the user and the project unless the
+	// specific ones are provided
+	if domainName, ok := config[configKeyDomainName]; ok {
+		ao.DomainName = domainName
+	}
+	if v, ok := config[configKeyUserDomainName]; ok {
+		ao.DomainName, ao.DomainID = v, ""
+	}
+	if v, ok := config[configKeyUserDomainID]; ok {
+		ao.DomainName, ao.DomainID = "", v
+	}
+
+	if err := validateAuthOptions(&ao, config); err != nil {
+		return ao, err
+	}
+
+	scope, err := authScope(&ao, config)
+	if err != nil {
+		return ao, err
+	}
+	if scope != nil {
+		ao.Scope = scope
+	}
+
+	ao.AllowReauth = true
+	return ao, nil
+}
+
+func validateAuthOptions(ao *gophercloud.AuthOptions, config map[string]string) error {
+	appCred := ao.ApplicationCredentialID != "" || ao.ApplicationCredentialName != ""
+
+	methods := 0
+	for _, set := range []bool{ao.Password != "", ao.TokenID != "", appCred} {
+		if set {
+			methods++
+		}
+	}
+	switch {
+	case methods == 0:
+		return fmt.Errorf("no credentials provided, set %s, %s or %s", configKeyPassword, configKeyToken, configKeyAppCredID)
+	case methods > 1:
+		return fmt.Errorf("only one of %s, %s or application credentials can be used", configKeyPassword, configKeyToken)
+	}
+
+	userDomain := ao.DomainID != "" || ao.DomainName != ""
+	switch {
+	case appCred:
+		if ao.ApplicationCredentialSecret == "" {
+			return fmt.Errorf("%s is required when using application credentials", configKeyAppCredSecret)
+		}
+		if ao.ApplicationCredentialID == "" {
+			if ao.UserID == "" && ao.Username == "" {
+				return fmt.Errorf("%s or %s is required when using %s", configKeyUserID, configKeyUsername, configKeyAppCredName)
+			}
+			if ao.UserID == "" && !userDomain {
+				return fmt.Errorf("%s or %s is required when using %s", configKeyUserDomainName, configKeyUserDomainID, configKeyUsername)
+			}
+		}
+		if hasAnyKey(config, configKeyProjectID, configKeyProjectName, configKeyProjectDomainID, configKeyProjectDomainName, configKeySystemScope) {
+			return fmt.Errorf("application credentials are already scoped, project and system scope options can't be used with them")
+		}
+	case ao.Password != "":
+		if ao.UserID == "" && ao.Username == "" {
+			return fmt.Errorf("%s or %s is required when using %s", configKeyUserID, configKeyUsername, configKeyPassword)
+		}
+		if ao.UserID == "" && !userDomain {
+			return fmt.Errorf("%s or %s is required when using %s", configKeyUserDomainName, configKeyUserDomainID, configKeyUsername)
+		}
+	case ao.TokenID != "":
+		if ao.UserID != "" || ao.Username != "" {
+			return fmt.Errorf("%s and %s can't be used with %s", configKeyUsername, configKeyUserID, configKeyToken)
+		}
+	}
+	return nil
+}
+
+// authScope returns the scope to request when it can't be inferred by
+// gophercloud from the project and user domain options.
+func authScope(ao *gophercloud.AuthOptions, config map[string]string) (*gophercloud.AuthScope, error) {
+	if v, ok := config[configKeySystemScope]; ok {
+		system, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for '%s': %v", configKeySystemScope, err)
+		}
+		if system {
+			if hasAnyKey(config, configKeyProjectID, configKeyProjectName, configKeyProjectDomainID, configKeyProjectDomainName) {
+				return nil, fmt.Errorf("%s can't be used with project scope options", configKeySystemScope)
+			}
+			return &gophercloud.AuthScope{System: true}, nil
+		}
+	}
+
+	projectDomainID, hasID := config[configKeyProjectDomainID]
+	projectDomainName, hasName := config[configKeyProjectDomainName]
+	if hasID && hasName {
+		return nil, fmt.Errorf("only one of %s or %s can be used", configKeyProjectDomainID, configKeyProjectDomainName)
+	}
+	if ao.TenantID != "" {
+		// the project ID is enough to scope the token
+		return nil, nil
+	}
+	if !hasID && !hasName {
+		if ao.TenantName != "" && ao.DomainID == "" && ao.DomainName == "" {
+			return nil, fmt.Errorf("%s or %s is required when using %s", configKeyProjectDomainName, configKeyProjectDomainID, configKeyProjectName)
+		}
+		return nil, nil
+	}
+	if ao.TenantName == "" {
+		return nil, fmt.Errorf("%s is required when using a project domain", configKeyProjectName)
+	}
+	return &gophercloud.AuthScope{
+		ProjectName: ao.TenantName,
+		DomainID:    projectDomainID,
+		DomainName:  projectDomainName,
+	}, nil
+}
+
+func hasAnyKey(config map[string]string, keys ...string) bool {
+	for _, key := range keys {
+		if _, ok := config[key]; ok {
+			return true
+		}
+	}
+	return false
+}
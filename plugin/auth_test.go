@@ -0,0 +1,370 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AuthOptions(t *testing.T) {
+	// don't take the options from the environment
+	t.Setenv("OS_AUTH_URL", "")
+
+	testCases := []struct {
+		name          string
+		config        map[string]string
+		expectedScope *gophercloud.AuthScope
+		expectedErr   bool
+	}{
+		{
+			name:   "password with domain name",
+			config: map[string]string{"username": "user", "password": "pass", "domain_name": "dom", "project_name": "proj"},
+		},
+		{
+			name:        "password without user",
+			config:      map[string]string{"password": "pass", "project_id": "123"},
+			expectedErr: true,
+		},
+		{
+			name:        "username without domain",
+			config:      map[string]string{"username": "user", "password": "pass", "project_id": "123"},
+			expectedErr: true,
+		},
+		{
+			name:        "project name without domain",
+			config:      map[string]string{"user_id": "456", "password": "pass", "project_name": "proj"},
+			expectedErr: true,
+		},
+		{
+			name: "split domains",
+			config: map[string]string{"username": "user", "password": "pass", "user_domain_name": "users",
+				"project_name": "proj", "project_domain_id": "abc"},
+			expectedScope: &gophercloud.AuthScope{ProjectName: "proj", DomainID: "abc"},
+		},
+		{
+			name:        "both project domains",
+			config:      map[string]string{"user_id": "456", "password": "pass", "project_name": "proj", "project_domain_id": "abc", "project_domain_name": "projects"},
+			expectedErr: true,
+		},
+		{
+			name:   "application credential id",
+			config: map[string]string{"application_credential_id": "789", "application_credential_secret": "secret"},
+		},
+		{
+			name:        "application credential without secret",
+			config:      map[string]string{"application_credential_id": "789"},
+			expectedErr: true,
+		},
+		{
+			name:        "application credential name without user",
+			config:      map[string]string{"application_credential_name": "cred", "application_credential_secret": "secret"},
+			expectedErr: true,
+		},
+		{
+			name:        "application credential with project",
+			config:      map[string]string{"application_credential_id": "789", "application_credential_secret": "secret", "project_id": "123"},
+			expectedErr: true,
+		},
+		{
+			name:        "password and token",
+			config:      map[string]string{"user_id": "456", "password": "pass", "token": "tok"},
+			expectedErr: true,
+		},
+		{
+			name:        "token with username",
+			config:      map[string]string{"username": "user", "domain_name": "dom", "token": "tok"},
+			expectedErr: true,
+		},
+		{
+			name:          "token with system scope",
+			config:        map[string]string{"token": "tok", "system_scope": "true"},
+			expectedScope: &gophercloud.AuthScope{System: true},
+		},
+		{
+			name:        "system scope with project",
+			config:      map[string]string{"token": "tok", "system_scope": "true", "project_id": "123"},
+			expectedErr: true,
+		},
+		{
+			name:        "no credentials",
+			config:      map[string]string{"project_id": "123"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ao, err := authOptions(tc.config, nil)
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedScope, ao.Scope, tc.name)
+			assert.True(t, ao.AllowReauth, tc.name)
+		})
+	}
+
+	// a token replaces the user of the cloud
+	cloud := &cloudOptions{auth: gophercloud.AuthOptions{Username: "user", DomainName: "dom", Password: "pass"}}
+	ao, err := authOptions(map[string]string{"token": "tok"}, cloud)
+	assert.NoError(t, err)
+	assert.Equal(t, gophercloud.AuthOptions{TokenID: "tok", AllowReauth: true}, ao)
+}
+
+func Test_LoadCloud(t *testing.T) {
+	dir := t.TempDir()
+	cloudsFile := filepath.Join(dir, "clouds.yaml")
+	err := os.WriteFile(cloudsFile, []byte(`
+clouds:
+  mycloud:
+    region_name: RegionTwo
+    interface: internal
+    auth:
+      auth_url: https://keystone.example.com/v3
+      username: user
+      user_domain_name: users
+      project_name: proj
+`), 0o600)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "secure.yaml"), []byte(`
+clouds:
+  mycloud:
+    auth:
+      password: pass
+`), 0o600)
+	assert.NoError(t, err)
+
+	cloud, err := loadCloud(map[string]string{"cloud": "mycloud", "clouds_file": cloudsFile})
+	assert.NoError(t, err)
+
+	ao, err := authOptions(map[string]string{"username": "other"}, cloud)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://keystone.example.com/v3", ao.IdentityEndpoint)
+	assert.Equal(t, "other", ao.Username)
+	assert.Equal(t, "pass", ao.Password)
+	assert.Equal(t, "users", ao.DomainName)
+
+	eo, err := endpointOpts(map[string]string{}, cloud)
+	assert.NoError(t, err)
+	assert.Equal(t, "RegionTwo", eo.Region)
+	assert.Equal(t, gophercloud.AvailabilityInternal, eo.Availability)
+
+	eo, err = endpointOpts(map[string]string{"region_name": "RegionThree", "interface": "admin"}, cloud)
+	assert.NoError(t, err)
+	assert.Equal(t, "RegionThree", eo.Region)
+	assert.Equal(t, gophercloud.AvailabilityAdmin, eo.Availability)
+
+	_, err = endpointOpts(map[string]string{"interface": "private"}, nil)
+	assert.Error(t, err)
+
+	_, err = loadCloud(map[string]string{"cloud": "unknown", "clouds_file": cloudsFile})
+	assert.Error(t, err)
+}
+
+func Test_ReadSecretFiles(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("supersecret\n"), 0o600))
+
+	config := map[string]string{"username": "user", "password_file": passwordFile}
+	secrets, err := readSecretFiles(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "supersecret", secrets["password"])
+	assert.NotContains(t, config, "password")
+
+	_, err = readSecretFiles(map[string]string{"password": "pass", "password_file": passwordFile})
+	assert.Error(t, err)
+
+	_, err = readSecretFiles(map[string]string{"token_file": filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
+
+func Test_WatchSecretFiles(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		attempts = make(map[string]int)
+	)
+	keystone, used := newTestKeystone(t, func(password, _ string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts[password]++
+		if password == "old" || password == "new" {
+			return "token-" + password
+		}
+		return ""
+	})
+	authAttempts := func(password string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return attempts[password]
+	}
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("old\n"), 0o600))
+	config := map[string]string{
+		"auth_url": keystone + "/v3", "username": "user", "password_file": passwordFile, "domain_name": "dom",
+		"project_id": "p1", "secret_files_interval": "10ms",
+	}
+	ctx := context.Background()
+	p, err := newProviderClient(ctx, config, hclog.NewNullLogger())
+	assert.NoError(t, err)
+	stop, err := p.watchSecretFiles(hclog.NewNullLogger())
+	assert.NoError(t, err)
+	defer stop()
+
+	// lastToken makes a request and returns the token it used
+	lastToken := func() string {
+		_, err := p.Request(ctx, http.MethodGet, keystone+"/servers", &gophercloud.RequestOpts{OkCodes: []int{http.StatusOK}})
+		assert.NoError(t, err)
+		tokens := used()
+		return tokens[len(tokens)-1]
+	}
+	assert.Equal(t, "token-old", lastToken())
+
+	// invalid credentials keep the previous ones
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("bad\n"), 0o600))
+	assert.Eventually(t, func() bool { return authAttempts("bad") > 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "token-old", lastToken())
+
+	// as does an unreadable file
+	assert.NoError(t, os.Remove(passwordFile))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "token-old", lastToken())
+
+	// the requests in progress during the rotation keep working, and the next
+	// ones use the new token
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			_, err := p.Request(ctx, http.MethodGet, keystone+"/servers", &gophercloud.RequestOpts{OkCodes: []int{http.StatusOK}})
+			assert.NoError(t, err)
+		}
+	}()
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("new\n"), 0o600))
+	assert.Eventually(t, func() bool { return lastToken() == "token-new" }, 5*time.Second, 10*time.Millisecond)
+	<-done
+	assert.Equal(t, 1, authAttempts("new"))
+}
+
+func Test_Rotate(t *testing.T) {
+	keystone, used := newTestKeystone(t, func(password, _ string) string {
+		if password == "bad" {
+			return ""
+		}
+		return "token-" + password
+	})
+	config := map[string]string{"auth_url": keystone + "/v3", "username": "user", "password": "old", "domain_name": "dom", "project_id": "p1"}
+	ctx := context.Background()
+	p, err := newProviderClient(ctx, config, hclog.NewNullLogger())
+	assert.NoError(t, err)
+
+	assert.Error(t, p.rotate(map[string]string{"auth_url": keystone + "/v3", "username": "user", "password": "bad", "domain_name": "dom", "project_id": "p1"}))
+	assert.Equal(t, "token-old", p.Token())
+	assert.Equal(t, "old", p.auth.Password)
+
+	// the previous credentials are also used when the token expires
+	assert.NoError(t, p.reauthenticate(ctx))
+	assert.Equal(t, "token-old", p.Token())
+
+	assert.NoError(t, p.rotate(map[string]string{"auth_url": keystone + "/v3", "username": "user", "password": "new", "domain_name": "dom", "project_id": "p1"}))
+	assert.Equal(t, "token-new", p.Token())
+	_, err = p.Request(ctx, http.MethodGet, keystone+"/servers", &gophercloud.RequestOpts{OkCodes: []int{http.StatusOK}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"token-new"}, used())
+}
+
+func Test_NewServiceClient(t *testing.T) {
+	provider := &gophercloud.ProviderClient{
+		EndpointLocator: func(eo gophercloud.EndpointOpts) (string, error) {
+			if eo.Type != "compute" || eo.Name != "nova" || eo.Availability != gophercloud.AvailabilityInternal {
+				return "", fmt.Errorf("endpoint not found")
+			}
+			return "https://nova.internal:8774/v2.1/", nil
+		},
+	}
+	eo := gophercloud.EndpointOpts{Region: "RegionOne", Availability: gophercloud.AvailabilityInternal}
+
+	client, err := newServiceClient(provider, eo, map[string]string{"compute_service_name": "nova"}, "compute", openstack.NewComputeV2)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://nova.internal:8774/v2.1/", client.Endpoint)
+
+	_, err = newServiceClient(provider, eo, map[string]string{}, "network", openstack.NewNetworkV2)
+	assert.Error(t, err)
+
+	client, err = newServiceClient(provider, eo, map[string]string{"network_endpoint": "https://neutron.example.com:9696"}, "network", openstack.NewNetworkV2)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://neutron.example.com:9696/", client.Endpoint)
+	assert.Equal(t, "https://neutron.example.com:9696/v2.0/", client.ResourceBase)
+	assert.Same(t, provider, client.ProviderClient)
+}
+
+// newTestKeystone returns the URL of a fake Keystone v3 API that issues the
+// token returned by the function for the password and project of each
+// authentication, rejecting it if the token is empty. The requests to any
+// other path succeed, and the returned function lists the tokens they used.
+func newTestKeystone(t *testing.T, token func(password, project string) string) (string, func() []string) {
+	var (
+		lock sync.Mutex
+		used []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost || r.URL.Path != "/v3/auth/tokens" {
+			lock.Lock()
+			used = append(used, r.Header.Get("X-Auth-Token"))
+			lock.Unlock()
+			_, _ = w.Write([]byte("{}"))
+			return
+		}
+
+		var req struct {
+			Auth struct {
+				Identity struct {
+					Password struct {
+						User struct {
+							Password string `json:"password"`
+						} `json:"user"`
+					} `json:"password"`
+				} `json:"identity"`
+				Scope struct {
+					Project struct {
+						ID string `json:"id"`
+					} `json:"project"`
+				} `json:"scope"`
+			} `json:"auth"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		issued := token(req.Auth.Identity.Password.User.Password, req.Auth.Scope.Project.ID)
+		if issued == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("{}"))
+			return
+		}
+		w.Header().Set("X-Subject-Token", issued)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]any{"token": map[string]any{
+			"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			"catalog":    []any{},
+		}})
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), used...)
+	}
+}
@@ -0,0 +1,183 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	configKeyBreakerThreshold   = "breaker_threshold"
+	configKeyBreakerCooldown    = "breaker_cooldown"
+	configKeyBreakerMaxCooldown = "breaker_max_cooldown"
+
+	defaultBreakerCooldown    = 5 * time.Minute
+	defaultBreakerMaxCooldown = 1 * time.Hour
+)
+
+// breakerPoolKeys are the policy target keys that identify the pool of every
+// mode.
+var breakerPoolKeys = []string{
+	configKeyPoolName, configKeyStackName, configKeySenlinCluster, configKeyMagnumCluster, configKeyMagnumNodeGroup,
+	configKeyCloud, configKeyRegionName, configKeyProjectID, configKeyProjectName,
+}
+
+// circuitBreakers stop the scale-outs of the pools that failed too many times
+// in a row, so a broken image or an exhausted quota don't create a new server
+// in ERROR on every policy evaluation.
+type circuitBreakers struct {
+	threshold   int // zero disables them
+	cooldown    time.Duration
+	maxCooldown time.Duration
+
+	lock  sync.Mutex
+	pools map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	trips     int
+	openUntil time.Time
+	lastErr   error
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{
+		cooldown:    defaultBreakerCooldown,
+		maxCooldown: defaultBreakerMaxCooldown,
+		pools:       make(map[string]*breakerState),
+	}
+}
+
+// configure applies the settings of the plugin config.
+func (c *circuitBreakers) configure(config map[string]string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.threshold = 0
+	if v, ok := config[configKeyBreakerThreshold]; ok && v != "" {
+		threshold, err := strconv.Atoi(v)
+		if err != nil || threshold < 0 {
+			return fmt.Errorf("invalid value for '%s': must be a positive integer", configKeyBreakerThreshold)
+		}
+		c.threshold = threshold
+	}
+
+	c.cooldown, c.maxCooldown = defaultBreakerCooldown, defaultBreakerMaxCooldown
+	for key, field := range map[string]*time.Duration{
+		configKeyBreakerCooldown:    &c.cooldown,
+		configKeyBreakerMaxCooldown: &c.maxCooldown,
+	} {
+		if v, ok := config[key]; ok && v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", key, err)
+			}
+			*field = d
+		}
+	}
+	if c.cooldown > c.maxCooldown {
+		return fmt.Errorf("%s can't be greater than %s", configKeyBreakerCooldown, configKeyBreakerMaxCooldown)
+	}
+	c.pools = make(map[string]*breakerState)
+	return nil
+}
+
+// allow returns an error if the scale-outs of the pool are suspended.
+func (c *circuitBreakers) allow(pool string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	state, ok := c.pools[pool]
+	if c.threshold == 0 || !ok || !time.Now().Before(state.openUntil) {
+		return nil
+	}
+	return fmt.Errorf("scale-out suspended until %s after %d consecutive failures, last error: %v",
+		state.openUntil.Format(time.RFC3339), state.failures, state.lastErr)
+}
+
+type breakerPoolKey struct{}
+
+func withBreakerPool(ctx context.Context, pool string) context.Context {
+	return context.WithValue(ctx, breakerPoolKey{}, pool)
+}
+
+// allowScaleOut returns an error if the scale-outs of the pool of the scaling
+// action in progress are suspended. The modes call it once the current count
+// tells the action scales out, whatever the direction of the action.
+func (t *TargetPlugin) allowScaleOut(ctx context.Context) error {
+	pool, ok := ctx.Value(breakerPoolKey{}).(string)
+	if !ok {
+		return nil
+	}
+	return t.breakers.allow(pool)
+}
+
+// record updates the failures of the pool with the result of a scale-out,
+// opening the breaker when they reach the threshold. Every time it opens again
+// the cooldown doubles, up to the maximum one. A success closes it.
+func (c *circuitBreakers) record(pool string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.threshold == 0 {
+		return
+	}
+	if err == nil {
+		delete(c.pools, pool)
+		return
+	}
+
+	state, ok := c.pools[pool]
+	if !ok {
+		state = &breakerState{}
+		c.pools[pool] = state
+	}
+	state.failures++
+	state.lastErr = err
+	if state.failures < c.threshold {
+		return
+	}
+
+	cooldown := c.cooldown << state.trips
+	if cooldown <= 0 || cooldown > c.maxCooldown {
+		cooldown = c.maxCooldown
+	}
+	state.trips++
+	state.openUntil = time.Now().Add(cooldown)
+}
+
+// meta returns the state of the breaker of the pool to report in its status.
+func (c *circuitBreakers) meta(pool string) map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	state, ok := c.pools[pool]
+	if c.threshold == 0 || !ok {
+		return nil
+	}
+	meta := map[string]string{
+		"breaker_failures":   strconv.Itoa(state.failures),
+		"breaker_last_error": state.lastErr.Error(),
+		"breaker_state":      "closed",
+	}
+	if time.Now().Before(state.openUntil) {
+		meta["breaker_state"] = "open"
+		meta["breaker_open_until"] = state.openUntil.Format(time.RFC3339)
+	}
+	return meta
+}
+
+// breakerPool identifies the pool of the policy target.
+func breakerPool(mode string, config map[string]string) string {
+	parts := []string{mode}
+	for _, key := range breakerPoolKeys {
+		if v, ok := config[key]; ok {
+			parts = append(parts, key+"="+v)
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CircuitBreakers(t *testing.T) {
+	breakers := newCircuitBreakers()
+	assert.NoError(t, breakers.configure(map[string]string{"breaker_threshold": "2", "breaker_cooldown": "1m", "breaker_max_cooldown": "3m"}))
+	pool := breakerPool(modeServers, map[string]string{"pool_name": "workers"})
+	failure := fmt.Errorf("quota exceeded")
+
+	breakers.record(pool, failure)
+	assert.NoError(t, breakers.allow(pool))
+	assert.Equal(t, "closed", breakers.meta(pool)["breaker_state"])
+
+	breakers.record(pool, failure)
+	assert.ErrorContains(t, breakers.allow(pool), "quota exceeded")
+	assert.Equal(t, "open", breakers.meta(pool)["breaker_state"])
+	assert.WithinDuration(t, time.Now().Add(time.Minute), breakers.pools[pool].openUntil, time.Second)
+
+	// other pools aren't affected
+	assert.NoError(t, breakers.allow(breakerPool(modeServers, map[string]string{"pool_name": "other"})))
+
+	// the cooldown doubles every time the breaker opens, up to the maximum
+	breakers.record(pool, failure)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), breakers.pools[pool].openUntil, time.Second)
+	breakers.record(pool, failure)
+	assert.WithinDuration(t, time.Now().Add(3*time.Minute), breakers.pools[pool].openUntil, time.Second)
+
+	breakers.record(pool, nil)
+	assert.NoError(t, breakers.allow(pool))
+	assert.Nil(t, breakers.meta(pool))
+
+	assert.Error(t, breakers.configure(map[string]string{"breaker_threshold": "-1"}))
+	assert.Error(t, breakers.configure(map[string]string{"breaker_cooldown": "2h"}))
+
+	// disabled by default
+	assert.NoError(t, breakers.configure(map[string]string{}))
+	breakers.record(pool, failure)
+	assert.NoError(t, breakers.allow(pool))
+}
+
+func Test_ScaleRecordsBreaker(t *testing.T) {
+	// the stack update always fails
+	client := newTestServiceClient(t, map[string]any{
+		"GET /stacks/nomad": map[string]any{"stack": map[string]any{
+			"id": "s1", "stack_name": "nomad", "parameters": map[string]string{"count": "3"},
+		}},
+		"GET /stacks/nomad/s1/resources/workers": map[string]any{"resource": map[string]any{"resource_type": resourceTypeResourceGroup}},
+	})
+	p := &TargetPlugin{
+		logger:       hclog.NewNullLogger(),
+		osClients:    &osClients{orchestrationClient: client},
+		breakers:     newCircuitBreakers(),
+		scaleTimeout: time.Minute,
+	}
+	assert.NoError(t, p.breakers.configure(map[string]string{"breaker_threshold": "1"}))
+	config := map[string]string{"mode": modeHeat, "stack_name": "nomad", "stack_resource_name": "workers"}
+	pool := breakerPool(modeHeat, config)
+
+	// an up action that turns out to be a scale in or no change doesn't count
+	assert.NoError(t, p.Scale(sdk.ScalingAction{Count: 3, Direction: sdk.ScaleDirectionUp}, config))
+	assert.Error(t, p.Scale(sdk.ScalingAction{Count: 2, Direction: sdk.ScaleDirectionUp}, config))
+	assert.Nil(t, p.breakers.meta(pool))
+
+	assert.Error(t, p.Scale(sdk.ScalingAction{Count: 5, Direction: sdk.ScaleDirectionUp}, config))
+	assert.Equal(t, "open", p.breakers.meta(pool)["breaker_state"])
+
+	// the open breaker refuses the scale-outs whatever the action direction,
+	// but not the scale-ins
+	for _, direction := range []sdk.ScaleDirection{sdk.ScaleDirectionUp, sdk.ScaleDirectionNone, sdk.ScaleDirectionDown} {
+		err := p.Scale(sdk.ScalingAction{Count: 5, Direction: direction}, config)
+		assert.ErrorContains(t, err, "scale-out suspended", direction.String())
+	}
+	err := p.Scale(sdk.ScalingAction{Count: 2, Direction: sdk.ScaleDirectionNone}, config)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "scale-out suspended")
+}
@@ -0,0 +1,330 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/availabilityzones"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/hypervisors"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/limits"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/v2/openstack/identity/v3/tokens"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/extensions/quotas"
+	"github.com/gophercloud/gophercloud/v2/pagination"
+	flavorutils "github.com/gophercloud/utils/v2/openstack/compute/v2/flavors"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/plugins"
+	"github.com/hashicorp/nomad-autoscaler/plugins/base"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+const (
+	// capacityPluginName is the unique name of the this plugin amongst APM plugins.
+	capacityPluginName = "os-capacity"
+
+	configKeyCPURatio  = "cpu_allocation_ratio"
+	configKeyRAMRatio  = "ram_allocation_ratio"
+	configKeyDiskRatio = "disk_allocation_ratio"
+
+	// hypervisor usage fields were removed from the API in 2.88
+	capacityComputeMicroversion = "2.53"
+
+	// unlimitedQuota is returned as remaining quota when there's no limit.
+	unlimitedQuota = math.MaxInt32
+)
+
+var (
+	CapacityPluginConfig = &plugins.InternalPluginConfig{
+		Factory: func(l hclog.Logger) interface{} { return NewCapacityAPMPlugin(l) },
+	}
+
+	capacityPluginInfo = &base.PluginInfo{
+		Name:       capacityPluginName,
+		PluginType: sdk.PluginTypeAPM,
+	}
+)
+
+// CapacityAPMPlugin is the APM implementation that exposes the remaining
+// project quota, the free hypervisor capacity and the server counts of pools.
+type CapacityAPMPlugin struct {
+	config           map[string]string
+	logger           hclog.Logger
+	computeClient    *gophercloud.ServiceClient
+	networkClient    *gophercloud.ServiceClient
+	stopSecretsWatch func()
+	projectID        string
+	queryTimeout     time.Duration
+	ratios           allocationRatios
+}
+
+// NewCapacityAPMPlugin returns the OS capacity implementation of the apm.APM
+// interface.
+func NewCapacityAPMPlugin(log hclog.Logger) *CapacityAPMPlugin {
+	return &CapacityAPMPlugin{
+		logger: log,
+	}
+}
+
+// SetConfig satisfies the SetConfig function on the base.Base interface.
+func (a *CapacityAPMPlugin) SetConfig(config map[string]string) error {
+	a.config = config
+
+	a.queryTimeout = defaultQueryTimeout
+	if timeout, ok := config[configKeyQueryTimeout]; ok {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse query_timeout: %v", err)
+		}
+		a.queryTimeout = d
+	}
+
+	a.ratios = allocationRatios{cpu: 1, ram: 1, disk: 1}
+	for key, ratio := range map[string]*float64{configKeyCPURatio: &a.ratios.cpu, configKeyRAMRatio: &a.ratios.ram, configKeyDiskRatio: &a.ratios.disk} {
+		if v, ok := config[key]; ok && v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f <= 0 {
+				return fmt.Errorf("invalid value for '%s': must be a positive number", key)
+			}
+			*ratio = f
+		}
+	}
+
+	provider, err := newProviderClient(context.Background(), config, a.logger)
+	if err != nil {
+		return err
+	}
+	if a.stopSecretsWatch != nil {
+		a.stopSecretsWatch()
+	}
+	if a.stopSecretsWatch, err = provider.watchSecretFiles(a.logger); err != nil {
+		return err
+	}
+
+	computeClient, err := newServiceClient(provider.ProviderClient, provider.endpoint, config, "compute", openstack.NewComputeV2)
+	if err != nil {
+		return fmt.Errorf("failed to create OS compute client: %v", err)
+	}
+	computeClient.Microversion = capacityComputeMicroversion
+	a.computeClient = computeClient
+
+	networkClient, err := newServiceClient(provider.ProviderClient, provider.endpoint, config, "network", openstack.NewNetworkV2)
+	if err != nil {
+		return fmt.Errorf("failed to create OS network client: %v", err)
+	}
+	a.networkClient = networkClient
+
+	a.projectID = config[configKeyProjectID]
+	if a.projectID == "" {
+		if r, ok := provider.GetAuthResult().(tokens.CreateResult); ok {
+			if project, err := r.ExtractProject(); err == nil && project != nil {
+				a.projectID = project.ID
+			}
+		}
+	}
+
+	a.logger.Info("completed set-up of plugin", "version", version)
+	return nil
+}
+
+// PluginInfo satisfies the PluginInfo function on the base.Base interface.
+func (a *CapacityAPMPlugin) PluginInfo() (*base.PluginInfo, error) {
+	return capacityPluginInfo, nil
+}
+
+// Query satisfies the Query function on the apm.APM interface.
+func (a *CapacityAPMPlugin) Query(query string, _ sdk.TimeRange) (sdk.TimestampedMetrics, error) {
+	parts := strings.Split(strings.TrimSpace(query), ":")
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.queryTimeout)
+	defer cancel()
+
+	var value float64
+	var err error
+	switch {
+	case len(parts) == 2 && parts[0] == "quota":
+		value, err = a.remainingQuota(ctx, parts[1])
+	case (len(parts) == 2 || len(parts) == 3) && parts[0] == "capacity":
+		var az string
+		if len(parts) == 3 {
+			az = parts[2]
+		}
+		value, err = a.freeCapacity(ctx, parts[1], az)
+	case len(parts) == 3 && parts[0] == "pool":
+		value, err = a.poolServers(ctx, parts[1], parts[2])
+	default:
+		return nil, fmt.Errorf("invalid query %q, expected quota:<resource>, capacity:<flavor>[:<az>] or pool:<pool_name>:<state>", query)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %v", query, err)
+	}
+
+	return sdk.TimestampedMetrics{{Timestamp: time.Now(), Value: value}}, nil
+}
+
+// QueryMultiple satisfies the QueryMultiple function on the apm.APM interface.
+func (a *CapacityAPMPlugin) QueryMultiple(query string, r sdk.TimeRange) ([]sdk.TimestampedMetrics, error) {
+	m, err := a.Query(query, r)
+	if err != nil {
+		return nil, err
+	}
+	return []sdk.TimestampedMetrics{m}, nil
+}
+
+func (a *CapacityAPMPlugin) remainingQuota(ctx context.Context, resource string) (float64, error) {
+	if resource == "floatingips" {
+		if a.projectID == "" {
+			return 0, fmt.Errorf("unable to discover project ID, set %s", configKeyProjectID)
+		}
+		q, err := quotas.GetDetail(ctx, a.networkClient, a.projectID).Extract()
+		if err != nil {
+			return 0, err
+		}
+		return remaining(q.FloatingIP.Limit, q.FloatingIP.Used+q.FloatingIP.Reserved), nil
+	}
+
+	l, err := limits.Get(ctx, a.computeClient, nil).Extract()
+	if err != nil {
+		return 0, err
+	}
+	switch resource {
+	case "instances":
+		return remaining(l.Absolute.MaxTotalInstances, l.Absolute.TotalInstancesUsed), nil
+	case "cores":
+		return remaining(l.Absolute.MaxTotalCores, l.Absolute.TotalCoresUsed), nil
+	case "ram":
+		return remaining(l.Absolute.MaxTotalRAMSize, l.Absolute.TotalRAMUsed), nil
+	}
+	return 0, fmt.Errorf("unknown quota resource %q", resource)
+}
+
+// freeCapacity returns how many servers of the flavor fit in the enabled
+// hypervisors, optionally restricted to the ones in an AZ.
+func (a *CapacityAPMPlugin) freeCapacity(ctx context.Context, flavorRef, az string) (float64, error) {
+	flavor, err := flavors.Get(ctx, a.computeClient, flavorRef).Extract()
+	if err != nil {
+		id, nameErr := flavorutils.IDFromName(ctx, a.computeClient, flavorRef)
+		if nameErr != nil {
+			return 0, fmt.Errorf("failed to find flavor %s", flavorRef)
+		}
+		if flavor, err = flavors.Get(ctx, a.computeClient, id).Extract(); err != nil {
+			return 0, err
+		}
+	}
+
+	var hosts map[string]struct{}
+	if az != "" {
+		if hosts, err = a.azHosts(ctx, az); err != nil {
+			return 0, err
+		}
+	}
+
+	var total int
+	err = hypervisors.List(a.computeClient, nil).EachPage(ctx, func(ctx context.Context, page pagination.Page) (bool, error) {
+		list, err := hypervisors.ExtractHypervisors(page)
+		if err != nil {
+			return false, err
+		}
+		for _, h := range list {
+			if h.Status != "enabled" || h.State != "up" {
+				continue
+			}
+			if hosts != nil {
+				if _, ok := hosts[h.Service.Host]; !ok {
+					continue
+				}
+			}
+			total += flavorSlots(h, flavor, a.ratios)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return float64(total), nil
+}
+
+func (a *CapacityAPMPlugin) azHosts(ctx context.Context, az string) (map[string]struct{}, error) {
+	allPages, err := availabilityzones.ListDetail(a.computeClient).AllPages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := availabilityzones.ExtractAvailabilityZones(allPages)
+	if err != nil {
+		return nil, err
+	}
+	for _, zone := range zones {
+		if zone.ZoneName != az {
+			continue
+		}
+		hosts := make(map[string]struct{}, len(zone.Hosts))
+		for host := range zone.Hosts {
+			hosts[host] = struct{}{}
+		}
+		return hosts, nil
+	}
+	return nil, fmt.Errorf("availability zone %s not found", az)
+}
+
+// poolServers counts the servers of the pool in the given state, or all of
+// them if the state is "total".
+func (a *CapacityAPMPlugin) poolServers(ctx context.Context, pool, state string) (float64, error) {
+	state = strings.ToUpper(state)
+	var count int
+	err := servers.List(a.computeClient, servers.ListOpts{Tags: fmt.Sprintf(poolTag, pool)}).EachPage(ctx, func(ctx context.Context, page pagination.Page) (bool, error) {
+		var serverList []customServer
+		if err := servers.ExtractServersInto(page, &serverList); err != nil {
+			return false, err
+		}
+		for _, s := range serverList {
+			if state == "TOTAL" || s.Status == state {
+				count++
+			}
+		}
+		return true, nil
+	})
+	return float64(count), err
+}
+
+type allocationRatios struct {
+	cpu  float64
+	ram  float64
+	disk float64
+}
+
+// flavorSlots returns how many servers of the flavor fit in the hypervisor.
+func flavorSlots(h hypervisors.Hypervisor, flavor *flavors.Flavor, ratios allocationRatios) int {
+	slots := math.MaxInt32
+	fit := func(capacity, used float64, size int) {
+		if size <= 0 {
+			return
+		}
+		free := int(math.Floor((capacity - used) / float64(size)))
+		if free < slots {
+			slots = free
+		}
+	}
+	fit(float64(h.VCPUs)*ratios.cpu, float64(h.VCPUsUsed), flavor.VCPUs)
+	fit(float64(h.MemoryMB)*ratios.ram, float64(h.MemoryMBUsed), flavor.RAM)
+	fit(float64(h.LocalGB)*ratios.disk, float64(h.LocalGBUsed), flavor.Disk)
+	if slots < 0 || slots == math.MaxInt32 {
+		return 0
+	}
+	return slots
+}
+
+func remaining(limit, used int) float64 {
+	if limit < 0 {
+		return unlimitedQuota
+	}
+	if used > limit {
+		return 0
+	}
+	return float64(limit - used)
+}
@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/hypervisors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FlavorSlots(t *testing.T) {
+	hypervisor := hypervisors.Hypervisor{
+		VCPUs:        16,
+		VCPUsUsed:    8,
+		MemoryMB:     65536,
+		MemoryMBUsed: 16384,
+		LocalGB:      500,
+		LocalGBUsed:  100,
+	}
+
+	testCases := []struct {
+		name     string
+		flavor   *flavors.Flavor
+		ratios   allocationRatios
+		expected int
+	}{
+		{
+			name:     "limited by cpu",
+			flavor:   &flavors.Flavor{VCPUs: 2, RAM: 4096, Disk: 20},
+			ratios:   allocationRatios{cpu: 1, ram: 1, disk: 1},
+			expected: 4,
+		},
+		{
+			name:     "cpu overcommit, limited by ram",
+			flavor:   &flavors.Flavor{VCPUs: 2, RAM: 8192, Disk: 20},
+			ratios:   allocationRatios{cpu: 4, ram: 1, disk: 1},
+			expected: 6,
+		},
+		{
+			name:     "boot from volume",
+			flavor:   &flavors.Flavor{VCPUs: 1, RAM: 1024, Disk: 0},
+			ratios:   allocationRatios{cpu: 1, ram: 1, disk: 1},
+			expected: 8,
+		},
+		{
+			name:     "no room",
+			flavor:   &flavors.Flavor{VCPUs: 16, RAM: 1024, Disk: 20},
+			ratios:   allocationRatios{cpu: 1, ram: 1, disk: 1},
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, flavorSlots(hypervisor, tc.flavor, tc.ratios), tc.name)
+		})
+	}
+}
+
+func Test_RemainingQuota(t *testing.T) {
+	assert.Equal(t, float64(3), remaining(10, 7))
+	assert.Equal(t, float64(0), remaining(10, 12))
+	assert.Equal(t, float64(unlimitedQuota), remaining(-1, 12))
+}
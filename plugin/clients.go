@@ -0,0 +1,270 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+)
+
+const (
+	configKeyProfile = "profile"
+
+	// profileKeyPrefix prefixes the plugin config keys of a credential
+	// profile, as in profile.<name>.<key>.
+	profileKeyPrefix = "profile."
+
+	// clientsRetryMin and clientsRetryMax bound the time the clients of a
+	// policy target that failed to be set up aren't set up again, doubling
+	// on every failure.
+	clientsRetryMin = 10 * time.Second
+	clientsRetryMax = 5 * time.Minute
+)
+
+// policyClientKeys are the keys a policy target can set to use a different
+// cloud, project or region than the one set in the plugin config.
+var policyClientKeys = []string{
+	configKeyProfile,
+	configKeyCloud,
+	configKeyRegionName,
+	configKeyProjectID,
+	configKeyProjectName,
+	configKeyProjectDomainID,
+	configKeyProjectDomainName,
+}
+
+// authConfigKeys are the config keys that select the cloud and credentials.
+var authConfigKeys = []string{
+	configKeyCloud, configKeyCloudsFile, configKeyAuthUrl, configKeyRegionName,
+	configKeyUsername, configKeyUserID, configKeyPassword, configKeyPasswordFile,
+	configKeyDomainName, configKeyUserDomainName, configKeyUserDomainID,
+	configKeyProjectID, configKeyProjectName, configKeyProjectDomainID, configKeyProjectDomainName,
+	configKeyAppCredID, configKeyAppCredName, configKeyAppCredSecret, configKeyAppCredSecretFile,
+	configKeyToken, configKeyTokenFile, configKeySystemScope,
+}
+
+// osClients holds the OS service clients of a cloud, project and region, and
+// the settings and caches that depend on them.
+type osClients struct {
+	computeClient        *gophercloud.ServiceClient
+	imageClient          *gophercloud.ServiceClient
+	networkClient        *gophercloud.ServiceClient
+	lbClient             *gophercloud.ServiceClient
+	dnsClient            *gophercloud.ServiceClient
+	orchestrationClient  *gophercloud.ServiceClient
+	clusteringClient     *gophercloud.ServiceClient
+	containerInfraClient *gophercloud.ServiceClient
+	regionName           string
+	stopSecretsWatch     func()
+
+	avZones   []string
+	cache     map[string]string
+	fipIDs    map[string]string
+	memberIDs map[string]string
+
+	lbPoolID     string
+	lbMemberPort int
+	lbSubnetID   string
+
+	dnsZoneID            string
+	dnsZoneName          string
+	dnsRecordTemplate    *template.Template
+	dnsTTL               int
+	dnsPTR               bool
+	dnsReconcileInterval time.Duration
+	dnsReconciles        *reconcileTimes
+}
+
+// clientsCache keeps the clients of the clouds, projects and regions selected
+// by the policies. The lock only guards the map, the clients are set up
+// outside of it so a slow cloud doesn't block the policies of the others.
+type clientsCache struct {
+	lock    sync.Mutex
+	clients map[string]*clientsEntry
+}
+
+// clientsEntry holds the clients of a policy target config, once set up, or
+// the error of the last setup and when it can be retried.
+type clientsEntry struct {
+	ready    chan struct{} // closed when the setup finishes
+	clients  *osClients
+	err      error
+	failures int
+	retryAt  time.Time
+}
+
+func newClientsCache() *clientsCache {
+	return &clientsCache{clients: make(map[string]*clientsEntry)}
+}
+
+// reset stops watching the secret files of the cached clients and removes them.
+// The clients being set up are stopped when their setup finishes.
+func (c *clientsCache) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, entry := range c.clients {
+		select {
+		case <-entry.ready:
+			if entry.clients != nil {
+				entry.clients.stopSecretsWatch()
+			}
+		default:
+		}
+	}
+	c.clients = make(map[string]*clientsEntry)
+}
+
+// entry returns the entry of the key and whether the caller must set it up,
+// as it's missing or its last setup failed and can be retried.
+func (c *clientsCache) entry(key string) (*clientsEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.clients[key]
+	if ok {
+		select {
+		case <-entry.ready:
+			if entry.err == nil || time.Now().Before(entry.retryAt) {
+				return entry, false
+			}
+		default:
+			return entry, false
+		}
+	}
+
+	next := &clientsEntry{ready: make(chan struct{})}
+	if ok {
+		next.failures = entry.failures
+	}
+	c.clients[key] = next
+	return next, true
+}
+
+// finish records the result of the setup of the entry, stopping the clients if
+// the cache was reset meanwhile.
+func (c *clientsCache) finish(key string, entry *clientsEntry, clients *osClients, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry.clients, entry.err = clients, err
+	if err != nil {
+		backoff := clientsRetryMin << entry.failures
+		if backoff <= 0 || backoff > clientsRetryMax {
+			backoff = clientsRetryMax
+		}
+		entry.failures++
+		entry.retryAt = time.Now().Add(backoff)
+	} else if c.clients[key] != entry {
+		clients.stopSecretsWatch()
+	}
+	close(entry.ready)
+}
+
+// withClients returns a copy of the plugin that uses the clients selected by
+// the policy target config. The plugin itself is returned if the policy
+// doesn't select any.
+func (t *TargetPlugin) withClients(ctx context.Context, config map[string]string) (*TargetPlugin, error) {
+	clientConfig, err := t.clientConfig(config)
+	if err != nil || clientConfig == nil {
+		return t, err
+	}
+	key := clientsKey(clientConfig)
+
+	entry, setup := t.clients.entry(key)
+	if setup {
+		tp := *t
+		err := tp.setupOSClients(ctx, clientConfig)
+		if err != nil {
+			tp.osClients = nil
+		} else {
+			t.logger.Info("set up clients of policy target", "region", tp.osClients.regionName)
+		}
+		t.clients.finish(key, entry, tp.osClients, err)
+	}
+
+	select {
+	case <-entry.ready:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to set up the clients of the policy target: %w", ctx.Err())
+	}
+	if entry.err != nil {
+		return nil, fmt.Errorf("failed to set up the clients of the policy target, retrying after %s: %v",
+			entry.retryAt.Format(time.RFC3339), entry.err)
+	}
+
+	tp := *t
+	tp.osClients = entry.clients
+	return &tp, nil
+}
+
+// clientConfig returns the plugin config with the cloud, project and region
+// selected by the policy target config, or nil if it doesn't select any.
+func (t *TargetPlugin) clientConfig(config map[string]string) (map[string]string, error) {
+	if !hasAnyKey(config, policyClientKeys...) {
+		return nil, nil
+	}
+
+	overrides := make(map[string]string)
+	if name, ok := config[configKeyProfile]; ok && name != "" {
+		prefix := profileKeyPrefix + name + "."
+		for k, v := range t.config {
+			if strings.HasPrefix(k, prefix) {
+				overrides[strings.TrimPrefix(k, prefix)] = v
+			}
+		}
+		if len(overrides) == 0 {
+			return nil, fmt.Errorf("profile %s not found in the plugin config", name)
+		}
+	}
+	for _, key := range policyClientKeys {
+		if v, ok := config[key]; ok && key != configKeyProfile {
+			overrides[key] = v
+		}
+	}
+	return mergeClientConfig(t.config, overrides), nil
+}
+
+// mergeClientConfig applies the overrides to the plugin config, removing the
+// settings that would conflict with them.
+func mergeClientConfig(base, overrides map[string]string) map[string]string {
+	result := make(map[string]string, len(base))
+	for k, v := range base {
+		if !strings.HasPrefix(k, profileKeyPrefix) {
+			result[k] = v
+		}
+	}
+
+	// a different cloud brings its own credentials
+	if _, ok := overrides[configKeyCloud]; ok {
+		for _, key := range authConfigKeys {
+			delete(result, key)
+		}
+	}
+	// the project ID would take precedence over the name
+	if hasAnyKey(overrides, configKeyProjectID, configKeyProjectName) {
+		for _, key := range []string{configKeyProjectID, configKeyProjectName, configKeyProjectDomainID, configKeyProjectDomainName} {
+			delete(result, key)
+		}
+	}
+
+	maps.Copy(result, overrides)
+	return result
+}
+
+// clientsKey identifies the clients created with the config.
+func clientsKey(config map[string]string) string {
+	var parts []string
+	for _, key := range authConfigKeys {
+		if v, ok := config[key]; ok {
+			parts = append(parts, key+"="+v)
+		}
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,159 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ClientConfig(t *testing.T) {
+	plugin := &TargetPlugin{config: map[string]string{
+		"auth_url":                 "https://keystone.example.com/v3",
+		"username":                 "user",
+		"password":                 "pass",
+		"domain_name":              "dom",
+		"project_id":               "123",
+		"region_name":              "RegionOne",
+		"profile.other.username":   "other",
+		"profile.other.password":   "otherpass",
+		"profile.other.project_id": "456",
+	}}
+
+	testCases := []struct {
+		name        string
+		policy      map[string]string
+		expected    map[string]string
+		expectedErr bool
+	}{
+		{
+			name:   "no selection",
+			policy: map[string]string{"pool_name": "pool"},
+		},
+		{
+			name:   "region",
+			policy: map[string]string{"region_name": "RegionTwo"},
+			expected: map[string]string{"auth_url": "https://keystone.example.com/v3", "username": "user", "password": "pass",
+				"domain_name": "dom", "project_id": "123", "region_name": "RegionTwo"},
+		},
+		{
+			name:   "project name replaces project id",
+			policy: map[string]string{"project_name": "proj"},
+			expected: map[string]string{"auth_url": "https://keystone.example.com/v3", "username": "user", "password": "pass",
+				"domain_name": "dom", "project_name": "proj", "region_name": "RegionOne"},
+		},
+		{
+			name:     "cloud replaces credentials",
+			policy:   map[string]string{"cloud": "mycloud"},
+			expected: map[string]string{"cloud": "mycloud"},
+		},
+		{
+			name:   "profile",
+			policy: map[string]string{"profile": "other", "region_name": "RegionTwo"},
+			expected: map[string]string{"auth_url": "https://keystone.example.com/v3", "username": "other", "password": "otherpass",
+				"domain_name": "dom", "project_id": "456", "region_name": "RegionTwo"},
+		},
+		{
+			name:        "unknown profile",
+			policy:      map[string]string{"profile": "unknown"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := plugin.clientConfig(tc.policy)
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expected, config, tc.name)
+		})
+	}
+}
+
+func Test_ClientsKey(t *testing.T) {
+	a := clientsKey(map[string]string{"cloud": "mycloud", "region_name": "RegionOne", "pool_name": "a"})
+	b := clientsKey(map[string]string{"region_name": "RegionOne", "cloud": "mycloud", "pool_name": "b"})
+	c := clientsKey(map[string]string{"cloud": "mycloud", "region_name": "RegionTwo"})
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+}
+
+func Test_WithClients(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		attempts = make(map[string]int)
+	)
+	started, release := make(chan struct{}), make(chan struct{})
+	keystone, _ := newTestKeystone(t, func(_, project string) string {
+		lock.Lock()
+		attempts[project]++
+		lock.Unlock()
+		switch project {
+		case "slow":
+			close(started)
+			<-release
+		case "bad":
+			return ""
+		}
+		return "token-" + project
+	})
+
+	p := &TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		config: map[string]string{
+			"auth_url": keystone + "/v3", "username": "user", "password": "pass", "domain_name": "dom",
+			"compute_endpoint": keystone, "image_endpoint": keystone, "network_endpoint": keystone,
+		},
+		clients: newClientsCache(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a slow cloud doesn't block the policies of the others
+	slow := make(chan error)
+	go func() {
+		_, err := p.withClients(ctx, map[string]string{"project_id": "slow"})
+		slow <- err
+	}()
+	<-started
+	fast, err := p.withClients(ctx, map[string]string{"project_id": "fast"})
+	assert.NoError(t, err)
+	assert.NotNil(t, fast.osClients)
+
+	// the policies of the slow cloud wait for the setup in progress
+	waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = p.withClients(waitCtx, map[string]string{"project_id": "slow"})
+	waitCancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+	assert.NoError(t, <-slow)
+	again, err := p.withClients(ctx, map[string]string{"project_id": "slow"})
+	assert.NoError(t, err)
+	assert.NotNil(t, again.osClients)
+
+	// a failed setup isn't retried until the backoff expires
+	_, err = p.withClients(ctx, map[string]string{"project_id": "bad"})
+	assert.ErrorContains(t, err, "failed to set up the clients of the policy target")
+	_, err = p.withClients(ctx, map[string]string{"project_id": "bad"})
+	assert.ErrorContains(t, err, "retrying after")
+
+	lock.Lock()
+	assert.Equal(t, map[string]int{"slow": 1, "fast": 1, "bad": 1}, attempts)
+	lock.Unlock()
+
+	p.clients.lock.Lock()
+	p.clients.clients[clientsKey(mergeClientConfig(p.config, map[string]string{"project_id": "bad"}))].retryAt = time.Now()
+	p.clients.lock.Unlock()
+	_, err = p.withClients(ctx, map[string]string{"project_id": "bad"})
+	assert.Error(t, err)
+	lock.Lock()
+	assert.Equal(t, 2, attempts["bad"])
+	lock.Unlock()
+}
@@ -0,0 +1,373 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/v2/openstack/dns/v2/recordsets"
+	"github.com/gophercloud/gophercloud/v2/openstack/dns/v2/zones"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/v2/pagination"
+)
+
+const (
+	defaultDNSRecordTemplate    = "{{ .Name }}"
+	defaultDNSReconcileInterval = 5 * time.Minute
+)
+
+// configureDNS creates the designate client and stores the DNS settings if a
+// zone was provided in the plugin configuration.
+func (t *TargetPlugin) configureDNS(provider *gophercloud.ProviderClient, eo gophercloud.EndpointOpts, config map[string]string) error {
+	zoneID, zoneName := config[configKeyDNSZoneID], config[configKeyDNSZone]
+	if zoneID == "" && zoneName == "" {
+		return nil
+	}
+
+	recordTemplate := defaultDNSRecordTemplate
+	if v, ok := config[configKeyDNSRecordT]; ok && strings.TrimSpace(v) != "" {
+		recordTemplate = strings.TrimSpace(v)
+	}
+	tmpl, err := template.New("dns").Parse(recordTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid value for '%s': %v", configKeyDNSRecordT, err)
+	}
+	t.dnsRecordTemplate = tmpl
+
+	t.dnsTTL = 0
+	if v, ok := config[configKeyDNSTTL]; ok && v != "" {
+		ttl, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for '%s': %v", configKeyDNSTTL, err)
+		}
+		t.dnsTTL = ttl
+	}
+
+	t.dnsReconcileInterval = defaultDNSReconcileInterval
+	if v, ok := config[configKeyDNSReconcile]; ok && v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %v", configKeyDNSReconcile, err)
+		}
+		t.dnsReconcileInterval = d
+	}
+
+	t.dnsReconciles = newReconcileTimes()
+	t.dnsPTR = config[configKeyDNSPTR] != ""
+	t.dnsZoneID = zoneID
+	t.dnsZoneName = zoneName
+	t.regionName = eo.Region
+
+	dnsClient, err := newServiceClient(provider, eo, config, "dns", openstack.NewDNSV2)
+	if err != nil {
+		return fmt.Errorf("failed to create OS dns client: %v", err)
+	}
+	t.dnsClient = dnsClient
+	return nil
+}
+
+// resolveDNSZone fills whichever of the zone ID or name wasn't configured.
+func (t *TargetPlugin) resolveDNSZone(ctx context.Context) error {
+	if t.dnsZoneID != "" {
+		zone, err := zones.Get(ctx, t.dnsClient, t.dnsZoneID).Extract()
+		if err != nil {
+			return fmt.Errorf("failed to get dns zone %s: %v", t.dnsZoneID, err)
+		}
+		t.dnsZoneName = zone.Name
+		return nil
+	}
+
+	allPages, err := zones.List(t.dnsClient, zones.ListOpts{Name: t.dnsZoneName}).AllPages(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list dns zones: %v", err)
+	}
+	zoneList, err := zones.ExtractZones(allPages)
+	if err != nil {
+		return fmt.Errorf("failed to extract dns zones: %v", err)
+	}
+	if len(zoneList) == 0 {
+		return fmt.Errorf("can't find dns zone %s", t.dnsZoneName)
+	}
+	t.dnsZoneID = zoneList[0].ID
+	t.dnsZoneName = zoneList[0].Name
+	return nil
+}
+
+// dnsRecordName renders the record template for the server and returns it as
+// a fully qualified name inside the configured zone.
+func (t *TargetPlugin) dnsRecordName(server *servers.Server) (string, error) {
+	td := templateData{
+		Name:     server.Name,
+		AZ:       server.AvailabilityZone,
+		PoolName: poolFromTags(server.Tags),
+	}
+	buf := new(bytes.Buffer)
+	if err := t.dnsRecordTemplate.Execute(buf, td); err != nil {
+		return "", fmt.Errorf("error executing dns record template: %s", err)
+	}
+	return qualifyRecordName(buf.String(), t.dnsZoneName), nil
+}
+
+// createDNSRecords creates (or updates) the A/AAAA records of the server and
+// sets the PTR record of its floating ip if that was requested.
+func (t *TargetPlugin) createDNSRecords(ctx context.Context, serverID string) error {
+	log := t.logger.With("action", "create_dns", "instance_id", serverID)
+
+	server, err := servers.Get(ctx, t.computeClient, serverID).Extract()
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+	name, err := t.dnsRecordName(server)
+	if err != nil {
+		return err
+	}
+
+	records := make(map[string][]string)
+	for _, addr := range parseServerAddresses(server.Addresses) {
+		if addr.floating {
+			continue
+		}
+		recordType := "A"
+		if addr.version == 6 {
+			recordType = "AAAA"
+		}
+		records[recordType] = append(records[recordType], addr.address)
+	}
+
+	// publish the floating ip instead of the fixed addresses if there's one
+	var fip *floatingips.FloatingIP
+	if fipID, ok := t.fipIDs[serverID]; ok {
+		fip, err = floatingips.Get(ctx, t.networkClient, fipID).Extract()
+		if err != nil {
+			return fmt.Errorf("failed to get floating ip %s: %w", fipID, err)
+		}
+		recordType := "A"
+		if ipVersion(fip.FloatingIP) == 6 {
+			recordType = "AAAA"
+		}
+		records[recordType] = []string{fip.FloatingIP}
+	}
+
+	for recordType, addresses := range records {
+		if err := t.ensureRecordSet(ctx, name, recordType, addresses); err != nil {
+			return err
+		}
+		log.Debug("dns record set", "name", name, "type", recordType, "records", addresses)
+	}
+
+	if t.dnsPTR && fip != nil {
+		if err := t.setFloatingIPPTR(ctx, fip.ID, &name); err != nil {
+			return fmt.Errorf("failed to set PTR record for floating ip %s: %w", fip.ID, err)
+		}
+		log.Debug("floating ip PTR record set", "name", name)
+	}
+	return nil
+}
+
+func (t *TargetPlugin) ensureRecordSet(ctx context.Context, name, recordType string, records []string) error {
+	existing, err := t.findRecordSets(ctx, recordsets.ListOpts{Name: name, Type: recordType})
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		updateOpts := recordsets.UpdateOpts{Records: records}
+		if t.dnsTTL > 0 {
+			updateOpts.TTL = &t.dnsTTL
+		}
+		if _, err := recordsets.Update(ctx, t.dnsClient, t.dnsZoneID, existing[0].ID, updateOpts).Extract(); err != nil {
+			return fmt.Errorf("failed to update %s record %s: %w", recordType, name, err)
+		}
+		return nil
+	}
+
+	createOpts := recordsets.CreateOpts{
+		Name:    name,
+		Type:    recordType,
+		Records: records,
+		TTL:     t.dnsTTL,
+	}
+	if _, err := recordsets.Create(ctx, t.dnsClient, t.dnsZoneID, createOpts).Extract(); err != nil {
+		return fmt.Errorf("failed to create %s record %s: %w", recordType, name, err)
+	}
+	return nil
+}
+
+func (t *TargetPlugin) findRecordSets(ctx context.Context, opts recordsets.ListOpts) ([]recordsets.RecordSet, error) {
+	var result []recordsets.RecordSet
+	err := recordsets.ListByZone(t.dnsClient, t.dnsZoneID, opts).EachPage(ctx, func(ctx context.Context, page pagination.Page) (bool, error) {
+		list, err := recordsets.ExtractRecordSets(page)
+		if err != nil {
+			return false, err
+		}
+		result = append(result, list...)
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dns records: %w", err)
+	}
+	return result, nil
+}
+
+// deleteDNSRecords removes the A/AAAA records of the server and the PTR record
+// of its floating ip. It must be called before the server is deleted.
+func (t *TargetPlugin) deleteDNSRecords(ctx context.Context, serverID string) error {
+	log := t.logger.With("action", "delete_dns", "instance_id", serverID)
+
+	server, err := servers.Get(ctx, t.computeClient, serverID).Extract()
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+	name, err := t.dnsRecordName(server)
+	if err != nil {
+		return err
+	}
+
+	existing, err := t.findRecordSets(ctx, recordsets.ListOpts{Name: name})
+	if err != nil {
+		return err
+	}
+	for _, rs := range existing {
+		if rs.Type != "A" && rs.Type != "AAAA" {
+			continue
+		}
+		if err := recordsets.Delete(ctx, t.dnsClient, t.dnsZoneID, rs.ID).ExtractErr(); err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete %s record %s: %w", rs.Type, name, err)
+		}
+		log.Debug("dns record deleted", "name", name, "type", rs.Type)
+	}
+
+	if fipID, ok := t.fipIDs[serverID]; ok && t.dnsPTR {
+		if err := t.setFloatingIPPTR(ctx, fipID, nil); err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to unset PTR record for floating ip %s: %w", fipID, err)
+		}
+		log.Debug("floating ip PTR record unset")
+	}
+	return nil
+}
+
+// setFloatingIPPTR sets the PTR record of a floating ip using the designate
+// reverse API. A nil name unsets the record.
+func (t *TargetPlugin) setFloatingIPPTR(ctx context.Context, fipID string, name *string) error {
+	body := map[string]any{"ptrdname": name}
+	if name != nil && t.dnsTTL > 0 {
+		body["ttl"] = t.dnsTTL
+	}
+	url := t.dnsClient.ServiceURL("reverse", "floatingips", fmt.Sprintf("%s:%s", t.regionName, fipID))
+	_, err := t.dnsClient.Patch(ctx, url, body, nil, &gophercloud.RequestOpts{OkCodes: []int{200, 202}})
+	return err
+}
+
+// reconcileDNSRecords creates the records of the ACTIVE servers in the pool
+// that are missing them. It runs at most once per reconcile interval and pool.
+func (t *TargetPlugin) reconcileDNSRecords(ctx context.Context, pool string) {
+	if t.dnsClient == nil || !t.dnsReconciles.due(pool, t.dnsReconcileInterval) {
+		return
+	}
+	log := t.logger.With("action", "reconcile_dns", "pool_name", pool)
+
+	existing, err := t.findRecordSets(ctx, recordsets.ListOpts{})
+	if err != nil {
+		log.Warn("failed to list dns records", "error", err)
+		return
+	}
+	names := make(map[string]struct{}, len(existing))
+	for _, rs := range existing {
+		if rs.Type == "A" || rs.Type == "AAAA" {
+			names[rs.Name] = struct{}{}
+		}
+	}
+
+	allPages, err := servers.List(t.computeClient, servers.ListOpts{Tags: fmt.Sprintf(poolTag, pool)}).AllPages(ctx)
+	if err != nil {
+		log.Warn("failed to list pool servers", "error", err)
+		return
+	}
+	serverList, err := servers.ExtractServers(allPages)
+	if err != nil {
+		log.Warn("failed to extract pool servers", "error", err)
+		return
+	}
+
+	for _, server := range serverList {
+		if server.Status != "ACTIVE" {
+			continue
+		}
+		name, err := t.dnsRecordName(&server)
+		if err != nil {
+			log.Warn("failed to render dns record name", "instance_id", server.ID, "error", err)
+			continue
+		}
+		if _, ok := names[name]; ok {
+			continue
+		}
+		log.Info("dns records missing for server, creating them", "instance_id", server.ID, "name", name)
+		if err := t.createDNSRecords(ctx, server.ID); err != nil {
+			log.Warn("failed to create dns records", "instance_id", server.ID, "error", err)
+		}
+	}
+}
+
+type serverAddress struct {
+	address  string
+	version  int
+	floating bool
+}
+
+// parseServerAddresses flattens the addresses field of a nova server.
+func parseServerAddresses(addresses map[string]any) []serverAddress {
+	var result []serverAddress
+	for _, v := range addresses {
+		list, ok := v.([]any)
+		if !ok {
+			continue
+		}
+		for _, item := range list {
+			m, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			addr, _ := m["addr"].(string)
+			if addr == "" {
+				continue
+			}
+			ipType, _ := m["OS-EXT-IPS:type"].(string)
+			result = append(result, serverAddress{
+				address:  addr,
+				version:  ipVersion(addr),
+				floating: ipType == "floating",
+			})
+		}
+	}
+	return result
+}
+
+func qualifyRecordName(name, zone string) string {
+	name = strings.TrimSpace(name)
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return fmt.Sprintf("%s.%s", name, strings.TrimSuffix(zone, ".")) + "."
+}
+
+func poolFromTags(tags *[]string) string {
+	if tags == nil {
+		return ""
+	}
+	prefix := strings.TrimSuffix(poolTag, "%s")
+	for _, tag := range *tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
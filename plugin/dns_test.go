@@ -0,0 +1,49 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_QualifyRecordName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		record   string
+		zone     string
+		expected string
+	}{
+		{name: "relative name", record: "node-1", zone: "example.com.", expected: "node-1.example.com."},
+		{name: "zone without dot", record: "node-1.pool", zone: "example.com", expected: "node-1.pool.example.com."},
+		{name: "already qualified", record: "node-1.other.org.", zone: "example.com.", expected: "node-1.other.org."},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, qualifyRecordName(tc.record, tc.zone), tc.name)
+		})
+	}
+}
+
+func Test_ParseServerAddresses(t *testing.T) {
+	addresses := map[string]any{
+		"private": []any{
+			map[string]any{"addr": "10.0.0.5", "version": float64(4), "OS-EXT-IPS:type": "fixed"},
+			map[string]any{"addr": "2001:db8::5", "version": float64(6), "OS-EXT-IPS:type": "fixed"},
+			map[string]any{"addr": "172.24.4.10", "version": float64(4), "OS-EXT-IPS:type": "floating"},
+		},
+	}
+
+	expected := []serverAddress{
+		{address: "10.0.0.5", version: 4},
+		{address: "2001:db8::5", version: 6},
+		{address: "172.24.4.10", version: 4, floating: true},
+	}
+	assert.Equal(t, expected, parseServerAddresses(addresses))
+}
+
+func Test_PoolFromTags(t *testing.T) {
+	tags := []string{"other", "na_pool:workers"}
+	assert.Equal(t, "workers", poolFromTags(&tags))
+	assert.Equal(t, "", poolFromTags(nil))
+}
@@ -0,0 +1,341 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/v2/openstack/orchestration/v1/stackresources"
+	"github.com/gophercloud/gophercloud/v2/openstack/orchestration/v1/stacks"
+	"github.com/gophercloud/gophercloud/v2/pagination"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+const (
+	defaultStackCountParameter = "count"
+
+	resourceTypeResourceGroup    = "OS::Heat::ResourceGroup"
+	resourceTypeAutoScalingGroup = "OS::Heat::AutoScalingGroup"
+	resourceTypeServer           = "OS::Nova::Server"
+)
+
+// stackMember is a member of a Heat scaling group mapped to the nova server it
+// contains.
+type stackMember struct {
+	name       string
+	physicalID string
+	serverID   string
+	created    time.Time
+}
+
+// stackGroup holds the information of the stack and group being scaled.
+type stackGroup struct {
+	stack          *stacks.RetrievedStack
+	resourceName   string
+	resourceType   string
+	countParameter string
+	removalParam   string
+}
+
+func (t *TargetPlugin) getStackGroup(ctx context.Context, config map[string]string) (*stackGroup, error) {
+	if t.orchestrationClient == nil {
+		return nil, fmt.Errorf("orchestration service is not available")
+	}
+	stackName, ok := config[configKeyStackName]
+	if !ok || stackName == "" {
+		return nil, fmt.Errorf("required config param %s not found", configKeyStackName)
+	}
+	resourceName, ok := config[configKeyStackResource]
+	if !ok || resourceName == "" {
+		return nil, fmt.Errorf("required config param %s not found", configKeyStackResource)
+	}
+
+	stack, err := stacks.Find(ctx, t.orchestrationClient, stackName).Extract()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find stack %s: %w", stackName, err)
+	}
+	group, err := stackresources.Get(ctx, t.orchestrationClient, stack.Name, stack.ID, resourceName).Extract()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stack resource %s: %w", resourceName, err)
+	}
+
+	sg := &stackGroup{
+		stack:          stack,
+		resourceName:   resourceName,
+		resourceType:   group.Type,
+		countParameter: defaultStackCountParameter,
+		removalParam:   config[configKeyStackRemovalParam],
+	}
+	if p, ok := config[configKeyStackCountParam]; ok && p != "" {
+		sg.countParameter = p
+	}
+	return sg, nil
+}
+
+func (sg *stackGroup) count() (int64, error) {
+	v, ok := sg.stack.Parameters[sg.countParameter]
+	if !ok {
+		return 0, fmt.Errorf("stack %s has no parameter %s", sg.stack.Name, sg.countParameter)
+	}
+	count, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for stack parameter %s: %v", sg.countParameter, err)
+	}
+	return count, nil
+}
+
+// stackMembers lists the members of the scaling group. Members can be servers
+// or nested stacks containing a server.
+func (t *TargetPlugin) stackMembers(ctx context.Context, sg *stackGroup) ([]stackMember, error) {
+	var resources []stackresources.Resource
+	err := stackresources.List(t.orchestrationClient, sg.stack.Name, sg.stack.ID, stackresources.ListOpts{Depth: 3}).EachPage(ctx, func(ctx context.Context, page pagination.Page) (bool, error) {
+		list, err := stackresources.ExtractResources(page)
+		if err != nil {
+			return false, err
+		}
+		resources = append(resources, list...)
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stack resources: %w", err)
+	}
+
+	var members []stackMember
+	for _, r := range resources {
+		if r.ParentResource != sg.resourceName || r.PhysicalID == "" {
+			continue
+		}
+		member := stackMember{name: r.Name, physicalID: r.PhysicalID, created: r.CreationTime}
+		if r.Type == resourceTypeServer {
+			member.serverID = r.PhysicalID
+		} else {
+			member.serverID = nestedServerID(resources, r.PhysicalID)
+		}
+		if member.serverID == "" {
+			t.logger.Warn("unable to find server of stack member", "member", r.Name)
+			continue
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// stackServerIDs returns the IDs of the servers of the scaling group.
+func (t *TargetPlugin) stackServerIDs(ctx context.Context, sg *stackGroup) ([]string, error) {
+	members, err := t.stackMembers(ctx, sg)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.serverID)
+	}
+	return ids, nil
+}
+
+// nestedServerID finds the server that belongs to the nested stack.
+func nestedServerID(resources []stackresources.Resource, stackID string) string {
+	for _, r := range resources {
+		if r.Type != resourceTypeServer {
+			continue
+		}
+		for _, link := range r.Links {
+			if link.Rel == "stack" && strings.HasSuffix(link.Href, "/"+stackID) {
+				return r.PhysicalID
+			}
+		}
+	}
+	return ""
+}
+
+// stackRemoteIDs returns the members indexed by the ID used to match them with
+// Nomad nodes.
+func (t *TargetPlugin) stackRemoteIDs(ctx context.Context, members []stackMember) (map[string]stackMember, error) {
+	result := make(map[string]stackMember, len(members))
+	for _, m := range members {
+		if t.idMapper {
+			result[m.serverID] = m
+			continue
+		}
+		server, err := servers.Get(ctx, t.computeClient, m.serverID).Extract()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get server %s: %w", m.serverID, err)
+		}
+		result[server.Name] = m
+	}
+	return result, nil
+}
+
+func (t *TargetPlugin) scaleStack(ctx context.Context, desired int64, config map[string]string) (string, error) {
+	sg, err := t.getStackGroup(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	current, err := sg.count()
+	if err != nil {
+		return "", err
+	}
+	auditFromContext(ctx).addCount(current)
+
+	log := t.logger.With("mode", modeHeat, "stack", sg.stack.Name, "resource", sg.resourceName)
+
+	diff, direction := t.calculateDirection(current, desired)
+	switch direction {
+	case "in":
+		err = t.scaleInStack(ctx, sg, current, diff, config)
+	case "out":
+		if err := t.allowScaleOut(ctx); err != nil {
+			return "", err
+		}
+		log.Debug("updating stack count", "current_count", current, "desired_count", desired)
+		err = t.auditScaleOut(ctx, func() ([]string, error) {
+			return t.stackServerIDs(ctx, sg)
+		}, func() error {
+			return t.updateStack(ctx, sg, map[string]any{sg.countParameter: desired})
+		})
+		if err == nil {
+			log.Info("successfully performed and verified scaling out")
+		}
+	default:
+		log.Info("scaling not required", "current_count", current, "strategy_count", desired)
+		return direction, nil
+	}
+	return direction, err
+}
+
+func (t *TargetPlugin) scaleInStack(ctx context.Context, sg *stackGroup, current, count int64, config map[string]string) error {
+	if sg.resourceType == resourceTypeResourceGroup && sg.removalParam == "" {
+		return fmt.Errorf("required config param %s to scale in a %s", configKeyStackRemovalParam, resourceTypeResourceGroup)
+	}
+
+	members, err := t.stackMembers(ctx, sg)
+	if err != nil {
+		return err
+	}
+	// autoscaling groups always remove the oldest members, so only those can be drained
+	if sg.resourceType == resourceTypeAutoScalingGroup {
+		sort.SliceStable(members, func(i, j int) bool { return members[i].created.Before(members[j].created) })
+		if int64(len(members)) > count {
+			members = members[:count]
+		}
+	}
+
+	byRemoteID, err := t.stackRemoteIDs(ctx, members)
+	if err != nil {
+		return err
+	}
+	remoteIDs := make([]string, 0, len(byRemoteID))
+	serverIDs := make(map[string]string, len(byRemoteID))
+	for id, member := range byRemoteID {
+		remoteIDs = append(remoteIDs, id)
+		serverIDs[id] = member.serverID
+	}
+
+	hooks, err := newWebhooks(config, t.logger)
+	if err != nil {
+		return err
+	}
+	jobs, err := newNomadJobs(t.nomadClient, config, t.logger)
+	if err != nil {
+		return err
+	}
+	ids, err := t.preScaleIn(ctx, config, remoteIDs, serverIDs, int(count), hooks, jobs)
+	if err != nil {
+		return fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %v", err)
+	}
+
+	log := t.logger.With("action", "scale_in", "mode", modeHeat, "stack", sg.stack.Name, "instances", ids)
+
+	// the group removes its oldest members whatever nodes were drained, so they
+	// all have to be, as the ones with live allocations would be destroyed
+	if sg.resourceType == resourceTypeAutoScalingGroup && int64(len(ids)) != count {
+		t.undrainNodes(ctx, ids)
+		return fmt.Errorf("only %d of the %d oldest members of %s could be drained, the group can't remove them",
+			len(ids), count, sg.resourceName)
+	}
+
+	removed := make([]string, 0, len(ids))
+	for _, id := range ids {
+		removed = append(removed, byRemoteID[id.RemoteResourceID].name)
+	}
+	params := map[string]any{sg.countParameter: current - int64(len(ids))}
+	if sg.removalParam != "" {
+		params[sg.removalParam] = []map[string][]string{{"resource_list": removed}}
+	}
+
+	log.Debug("updating stack to remove members", "members", removed)
+	if err := t.updateStack(ctx, sg, params); err != nil {
+		return err
+	}
+	log.Info("successfully removed stack members")
+	for _, id := range ids {
+		if err := t.serviceDeleted(ctx, hooks, config[configKeyPoolName], byRemoteID[id.RemoteResourceID].serverID, id); err != nil {
+			return err
+		}
+	}
+
+	if err := t.clusterUtils.RunPostScaleInTasks(ctx, config, ids); err != nil {
+		return fmt.Errorf("failed to perform post-scale Nomad scale in tasks: %v", err)
+	}
+
+	log.Info("successfully performed and verified scaling in")
+	return nil
+}
+
+// updateStack patches the stack parameters, keeping the current template, and
+// waits for the update to complete.
+func (t *TargetPlugin) updateStack(ctx context.Context, sg *stackGroup, params map[string]any) error {
+	opts := stacks.UpdateOpts{Parameters: params}
+	if err := stacks.UpdatePatch(ctx, t.orchestrationClient, sg.stack.Name, sg.stack.ID, opts).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to update stack %s: %w", sg.stack.Name, err)
+	}
+
+	// the update is asynchronous, so the status of the previous update can still
+	// be returned right after the patch: it only counts once the update started
+	previous := sg.stack.UpdatedTime
+	var started bool
+	err := gophercloud.WaitFor(ctx, func(ctx context.Context) (bool, error) {
+		stack, err := stacks.Get(ctx, t.orchestrationClient, sg.stack.Name, sg.stack.ID).Extract()
+		if err != nil {
+			return false, err
+		}
+		if stack.Status == "UPDATE_IN_PROGRESS" || stack.UpdatedTime.After(previous) {
+			started = true
+		}
+		if !started {
+			return false, nil
+		}
+		switch stack.Status {
+		case "UPDATE_COMPLETE":
+			return true, nil
+		case "UPDATE_FAILED", "ROLLBACK_COMPLETE", "ROLLBACK_FAILED":
+			return false, fmt.Errorf("stack update finished with status %s: %s", stack.Status, stack.StatusReason)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for stack %s to get to UPDATE_COMPLETE status: %w", sg.stack.Name, err)
+	}
+	return nil
+}
+
+func (t *TargetPlugin) statusStack(ctx context.Context, config map[string]string) (*sdk.TargetStatus, error) {
+	sg, err := t.getStackGroup(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	count, err := sg.count()
+	if err != nil {
+		return nil, err
+	}
+	return &sdk.TargetStatus{
+		Ready: !strings.HasSuffix(sg.stack.Status, "_IN_PROGRESS"),
+		Count: count,
+		Meta:  map[string]string{"stack_status": sg.stack.Status},
+	}, nil
+}
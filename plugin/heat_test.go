@@ -0,0 +1,254 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServiceClient returns an OpenStack service client of a fake API
+// serving the handlers, keyed by method and path like the ones of
+// newTestNomad. Writes are answered with 202 Accepted.
+func newTestServiceClient(t *testing.T, handlers map[string]any) *gophercloud.ServiceClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.Method+" "+r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if f, ok := handler.(func(*http.Request) any); ok {
+			handler = f(r)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		_ = json.NewEncoder(w).Encode(handler)
+	}))
+	t.Cleanup(server.Close)
+
+	return &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{HTTPClient: *server.Client()},
+		Endpoint:       server.URL + "/",
+	}
+}
+
+// newTestClusterUtils returns the cluster utils of a fake Nomad API with a
+// ready node of the wrkr class for each of the servers, created in order and
+// mapped to them by the server ID meta, and a client of the API. It also
+// returns a function listing the servers of the nodes still drained.
+func newTestClusterUtils(t *testing.T, servers ...string) (*scaleutils.ClusterScaleUtils, *api.Client, func() []string) {
+	var (
+		lock    sync.Mutex
+		drained = make(map[string]bool)
+	)
+	stubs := make([]*api.NodeListStub, 0, len(servers))
+	handlers := map[string]any{"GET /v1/nodes": &stubs}
+	for i, server := range servers {
+		nodeID := "node-" + server
+		stubs = append(stubs, &api.NodeListStub{
+			ID:                    nodeID,
+			NodeClass:             "wrkr",
+			Status:                api.NodeStatusReady,
+			SchedulingEligibility: api.NodeSchedulingEligible,
+			CreateIndex:           uint64(i + 1),
+		})
+		handlers["GET /v1/node/"+nodeID] = api.Node{
+			ID:        nodeID,
+			NodeClass: "wrkr",
+			Meta:      map[string]string{nodeMetaServerID: server},
+		}
+		handlers["GET /v1/node/"+nodeID+"/allocations"] = []*api.Allocation{}
+		handlers["PUT /v1/node/"+nodeID+"/drain"] = func(r *http.Request) any {
+			var req api.NodeUpdateDrainRequest
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			lock.Lock()
+			defer lock.Unlock()
+			drained[server] = req.DrainSpec != nil
+			return api.NodeDrainUpdateResponse{}
+		}
+	}
+	client := newTestNomad(t, handlers)
+
+	utils, err := scaleutils.NewClusterScaleUtils(&api.Config{Address: client.Address()}, hclog.NewNullLogger())
+	assert.NoError(t, err)
+	utils.ClusterNodeIDLookupFunc = osNovaNodeIDMapBuilder("", "meta."+nodeMetaServerID)
+
+	return utils, client, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		var servers []string
+		for server, ok := range drained {
+			if ok {
+				servers = append(servers, server)
+			}
+		}
+		sort.Strings(servers)
+		return servers
+	}
+}
+
+func Test_ScaleStack(t *testing.T) {
+	testCases := []struct {
+		name            string
+		resourceType    string
+		removalParam    string
+		nodes           []string
+		desired         int64
+		finalStatus     string
+		expectedParams  map[string]any
+		expectedDrain   []string
+		expectedCreated []auditServer
+		expectedDeleted []auditServer
+		expectedErr     bool
+	}{
+		{
+			name:            "scale out",
+			resourceType:    resourceTypeResourceGroup,
+			desired:         5,
+			finalStatus:     "UPDATE_COMPLETE",
+			expectedParams:  map[string]any{"count": float64(5)},
+			expectedCreated: []auditServer{{ID: "srv-4"}, {ID: "srv-5"}},
+		},
+		{
+			name:            "scale in resource group",
+			resourceType:    resourceTypeResourceGroup,
+			removalParam:    "removal_policies",
+			desired:         2,
+			finalStatus:     "UPDATE_COMPLETE",
+			expectedParams:  map[string]any{"count": float64(2), "removal_policies": []any{map[string]any{"resource_list": []any{"2"}}}},
+			expectedDrain:   []string{"srv-3"},
+			expectedDeleted: []auditServer{{ID: "srv-3"}},
+		},
+		{
+			name:            "scale in autoscaling group removes the oldest",
+			resourceType:    resourceTypeAutoScalingGroup,
+			desired:         2,
+			finalStatus:     "UPDATE_COMPLETE",
+			expectedParams:  map[string]any{"count": float64(2)},
+			expectedDrain:   []string{"srv-1"},
+			expectedDeleted: []auditServer{{ID: "srv-1"}},
+		},
+		{
+			// srv-1 has no node, so only srv-2 is drained and made eligible again
+			name:         "scale in autoscaling group without draining the oldest",
+			resourceType: resourceTypeAutoScalingGroup,
+			nodes:        []string{"srv-2", "srv-3"},
+			desired:      1,
+			expectedErr:  true,
+		},
+		{
+			name:         "scale in resource group without removal param",
+			resourceType: resourceTypeResourceGroup,
+			desired:      2,
+			expectedErr:  true,
+		},
+		{
+			// the stale UPDATE_COMPLETE of the previous update is ignored, and
+			// the servers created before the failure are audited
+			name:            "update failed",
+			resourceType:    resourceTypeResourceGroup,
+			desired:         5,
+			finalStatus:     "UPDATE_FAILED",
+			expectedParams:  map[string]any{"count": float64(5)},
+			expectedCreated: []auditServer{{ID: "srv-4"}, {ID: "srv-5"}},
+			expectedErr:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stack := func(status, updated string) any {
+				return map[string]any{"stack": map[string]any{
+					"id":           "s1",
+					"stack_name":   "nomad",
+					"stack_status": status,
+					"updated_time": updated,
+					"parameters":   map[string]string{"count": "3"},
+				}}
+			}
+			var resources []map[string]any
+			for i := range int(max(tc.desired, 3)) {
+				resources = append(resources, map[string]any{
+					"resource_name":        fmt.Sprint(i),
+					"resource_type":        resourceTypeServer,
+					"parent_resource":      "workers",
+					"physical_resource_id": fmt.Sprintf("srv-%d", i+1),
+					"creation_time":        fmt.Sprintf("2024-01-0%dT00:00:00Z", i+1),
+				})
+			}
+
+			var params map[string]any
+			var gets int
+			client := newTestServiceClient(t, map[string]any{
+				"GET /stacks/nomad":                      stack("UPDATE_COMPLETE", "2024-01-01T00:00:00Z"),
+				"GET /stacks/nomad/s1/resources/workers": map[string]any{"resource": map[string]any{"resource_type": tc.resourceType}},
+				"GET /stacks/nomad/s1/resources": func(*http.Request) any {
+					// the new servers are members once the stack is updated
+					if params == nil {
+						return map[string]any{"resources": resources[:3]}
+					}
+					return map[string]any{"resources": resources}
+				},
+				"PATCH /stacks/nomad/s1": func(r *http.Request) any {
+					var body struct {
+						Parameters map[string]any `json:"parameters"`
+					}
+					assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+					params = body.Parameters
+					return nil
+				},
+				"GET /stacks/nomad/s1": func(*http.Request) any {
+					gets++
+					if gets == 1 {
+						return stack("UPDATE_COMPLETE", "2024-01-01T00:00:00Z")
+					}
+					return stack(tc.finalStatus, "2024-02-01T00:00:00Z")
+				},
+			})
+			nodes := tc.nodes
+			if nodes == nil {
+				nodes = []string{"srv-1", "srv-2", "srv-3"}
+			}
+			utils, nomad, drained := newTestClusterUtils(t, nodes...)
+
+			p := &TargetPlugin{
+				logger:       hclog.NewNullLogger(),
+				osClients:    &osClients{orchestrationClient: client},
+				nomadClient:  nomad,
+				idMapper:     true,
+				clusterUtils: utils,
+			}
+			record := newAuditRecord(modeHeat, "workers", sdk.ScalingAction{Count: tc.desired})
+			_, err := p.scaleStack(withAuditRecord(context.Background(), record), tc.desired, map[string]string{
+				configKeyStackName:                   "nomad",
+				configKeyStackResource:               "workers",
+				configKeyStackRemovalParam:           tc.removalParam,
+				sdk.TargetConfigKeyClass:             "wrkr",
+				sdk.TargetConfigNodeSelectorStrategy: sdk.TargetNodeSelectorStrategyNewestCreateIndex,
+			})
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+			} else {
+				assert.NoError(t, err, tc.name)
+			}
+			assert.Equal(t, tc.expectedParams, params, tc.name)
+			assert.Equal(t, tc.expectedDrain, drained(), tc.name)
+			assert.Equal(t, int64(3), *record.PreviousCount, tc.name)
+			assert.Equal(t, tc.expectedCreated, record.Created, tc.name)
+			assert.Equal(t, tc.expectedDeleted, record.Deleted, tc.name)
+		})
+	}
+}
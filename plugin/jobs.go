@@ -0,0 +1,174 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+)
+
+const (
+	configKeyPreDeleteJob     = "pre_delete_job"
+	configKeyPostJoinJob      = "post_join_job"
+	configKeyJobTimeout       = "job_timeout"
+	configKeyJobFailurePolicy = "job_failure_policy"
+
+	defaultJobTimeout = 10 * time.Minute
+
+	// the meta keys of the dispatched jobs, they must be allowed by their
+	// parameterized block
+	jobMetaNodeID   = "node_id"
+	jobMetaServerID = "server_id"
+)
+
+// nomadJobs dispatch parameterized Nomad batch jobs before the nodes of the
+// pool are drained and after new ones join, waiting for them to complete.
+type nomadJobs struct {
+	client        *api.Client
+	preDelete     string
+	postJoin      string
+	timeout       time.Duration
+	failurePolicy string
+	logger        hclog.Logger
+}
+
+// newNomadJobs returns the jobs set in the policy target config, or nil if
+// none is set.
+func newNomadJobs(client *api.Client, config map[string]string, logger hclog.Logger) (*nomadJobs, error) {
+	preDelete, postJoin := config[configKeyPreDeleteJob], config[configKeyPostJoinJob]
+	if preDelete == "" && postJoin == "" {
+		return nil, nil
+	}
+
+	j := &nomadJobs{
+		client:    client,
+		preDelete: preDelete,
+		postJoin:  postJoin,
+		timeout:   defaultJobTimeout,
+		logger:    logger,
+	}
+	if v, ok := config[configKeyJobTimeout]; ok && v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", configKeyJobTimeout, err)
+		}
+		j.timeout = d
+	}
+	policy, err := parseFailurePolicy(config, configKeyJobFailurePolicy)
+	if err != nil {
+		return nil, err
+	}
+	j.failurePolicy = policy
+	return j, nil
+}
+
+// runPreDelete runs the pre_delete_job for the node, if set.
+func (j *nomadJobs) runPreDelete(ctx context.Context, nodeID, serverID string) error {
+	if j == nil || j.preDelete == "" {
+		return nil
+	}
+	return j.run(ctx, j.preDelete, nodeID, serverID)
+}
+
+// runPostJoin runs the post_join_job for the node, if set.
+func (j *nomadJobs) runPostJoin(ctx context.Context, nodeID, serverID string) error {
+	if j == nil || j.postJoin == "" {
+		return nil
+	}
+	return j.run(ctx, j.postJoin, nodeID, serverID)
+}
+
+// run dispatches the job with the node and server IDs as meta and waits for it
+// to complete, applying the failure policy if it doesn't.
+func (j *nomadJobs) run(ctx context.Context, jobID, nodeID, serverID string) error {
+	log := j.logger.With("job", jobID, "node_id", nodeID, "server_id", serverID)
+	ctx, cancel := context.WithTimeout(ctx, j.timeout)
+	defer cancel()
+
+	meta := map[string]string{jobMetaNodeID: nodeID, jobMetaServerID: serverID}
+	resp, _, err := j.client.Jobs().Dispatch(jobID, meta, nil, "", (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return j.failed(log, jobID, fmt.Errorf("failed to dispatch job: %v", err))
+	}
+	log = log.With("dispatched_job", resp.DispatchedJobID)
+	log.Debug("waiting for dispatched job to complete")
+
+	if err := j.waitForJob(ctx, resp.DispatchedJobID); err != nil {
+		return j.failed(log, jobID, err)
+	}
+	log.Info("dispatched job completed")
+	return nil
+}
+
+// waitForJob waits for the dispatched job to be dead, failing if any of its
+// allocations didn't complete.
+func (j *nomadJobs) waitForJob(ctx context.Context, jobID string) error {
+	return gophercloud.WaitFor(ctx, func(ctx context.Context) (bool, error) {
+		q := (&api.QueryOptions{}).WithContext(ctx)
+		job, _, err := j.client.Jobs().Info(jobID, q)
+		if err != nil {
+			return false, err
+		}
+		if job.Status == nil || *job.Status != "dead" {
+			return false, nil
+		}
+
+		summary, _, err := j.client.Jobs().Summary(jobID, q)
+		if err != nil {
+			return false, err
+		}
+		for group, s := range summary.Summary {
+			if s.Failed > 0 || s.Lost > 0 || s.Complete == 0 {
+				return false, fmt.Errorf("dispatched job %s didn't complete, group %s has %d complete, %d failed and %d lost allocations",
+					jobID, group, s.Complete, s.Failed, s.Lost)
+			}
+		}
+		return true, nil
+	})
+}
+
+// failed applies the failure policy.
+func (j *nomadJobs) failed(log hclog.Logger, jobID string, err error) error {
+	if j.failurePolicy == failurePolicyAbort {
+		return fmt.Errorf("job %s failed: %v", jobID, err)
+	}
+	log.Warn("job failed, going on with the action", "error", err)
+	return nil
+}
+
+// runPostJoinJob runs the post_join_job for the node of the new server,
+// waiting for it to join if it isn't known yet. The node not joining within the
+// job timeout is handled as a failure of the job. With the abort policy the
+// server is deleted when the job fails, like the ones whose node doesn't join,
+// so it isn't left in the pool without being set up.
+func (t *TargetPlugin) runPostJoinJob(ctx context.Context, common *commonCreateData, node *api.NodeListStub, serverID, serverName string) (err error) {
+	jobs := common.jobs
+	defer func() {
+		if err != nil {
+			t.logger.Warn("post_join_job failed, deleting server", "server", serverID, "error", err)
+			t.deleteFailedServer(ctx, common.pool, serverID)
+		}
+	}()
+
+	if node == nil {
+		joinCtx, cancel := context.WithTimeout(ctx, jobs.timeout)
+		defer cancel()
+
+		phaseCtx, end := startPhase(joinCtx, common.pool, phaseJoin)
+		n, err := t.waitForNode(phaseCtx, common.nodeClass, serverID, serverName)
+		end(err)
+		if err != nil {
+			log := jobs.logger.With("job", jobs.postJoin, "server_id", serverID)
+			return jobs.failed(log, jobs.postJoin, fmt.Errorf("node of server %s didn't join: %v", serverID, err))
+		}
+		node = n
+	}
+
+	phaseCtx, end := startPhase(ctx, common.pool, phaseJob)
+	err = jobs.runPostJoin(phaseCtx, node.ID, serverID)
+	end(err)
+	return err
+}
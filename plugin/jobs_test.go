@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestNomad returns a Nomad client of a fake API serving the handlers.
+func newTestNomad(t *testing.T, handlers map[string]any) *api.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.Method+" "+r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if f, ok := handler.(func(*http.Request) any); ok {
+			handler = f(r)
+		}
+		_ = json.NewEncoder(w).Encode(handler)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	assert.NoError(t, err)
+	return client
+}
+
+func Test_NomadJobs(t *testing.T) {
+	dead := "dead"
+	testCases := []struct {
+		name          string
+		summary       api.TaskGroupSummary
+		failurePolicy string
+		expectedErr   bool
+	}{
+		{name: "completed", summary: api.TaskGroupSummary{Complete: 1}},
+		{name: "failed", summary: api.TaskGroupSummary{Failed: 1}},
+		{name: "failed with abort", summary: api.TaskGroupSummary{Failed: 1}, failurePolicy: failurePolicyAbort, expectedErr: true},
+		{name: "not placed with abort", summary: api.TaskGroupSummary{}, failurePolicy: failurePolicyAbort, expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var meta map[string]string
+			client := newTestNomad(t, map[string]any{
+				"PUT /v1/job/flush/dispatch": func(r *http.Request) any {
+					var req api.JobDispatchRequest
+					assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+					meta = req.Meta
+					return api.JobDispatchResponse{DispatchedJobID: "flush/dispatch-1"}
+				},
+				"GET /v1/job/flush/dispatch-1":         api.Job{Status: &dead},
+				"GET /v1/job/flush/dispatch-1/summary": api.JobSummary{Summary: map[string]api.TaskGroupSummary{"flush": tc.summary}},
+			})
+
+			jobs, err := newNomadJobs(client, map[string]string{
+				configKeyPreDeleteJob:     "flush",
+				configKeyJobFailurePolicy: tc.failurePolicy,
+			}, hclog.NewNullLogger())
+			assert.NoError(t, err)
+
+			err = jobs.runPreDelete(context.Background(), "node-1", "server-1")
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+			} else {
+				assert.NoError(t, err, tc.name)
+			}
+			assert.Equal(t, map[string]string{jobMetaNodeID: "node-1", jobMetaServerID: "server-1"}, meta, tc.name)
+
+			// no post_join_job, nothing is dispatched
+			meta = nil
+			assert.NoError(t, jobs.runPostJoin(context.Background(), "node-1", "server-1"))
+			assert.Nil(t, meta)
+		})
+	}
+
+	jobs, err := newNomadJobs(nil, map[string]string{}, hclog.NewNullLogger())
+	assert.NoError(t, err)
+	assert.Nil(t, jobs)
+	_, err = newNomadJobs(nil, map[string]string{configKeyPostJoinJob: "warm", configKeyJobTimeout: "soon"}, hclog.NewNullLogger())
+	assert.Error(t, err)
+	_, err = newNomadJobs(nil, map[string]string{configKeyPostJoinJob: "warm", configKeyJobFailurePolicy: "retry"}, hclog.NewNullLogger())
+	assert.Error(t, err)
+}
+
+func Test_RunPostJoinJob(t *testing.T) {
+	dead := "dead"
+	testCases := []struct {
+		name            string
+		summary         api.TaskGroupSummary
+		failurePolicy   string
+		expectedDeleted bool
+		expectedErr     bool
+	}{
+		{name: "completed", summary: api.TaskGroupSummary{Complete: 1}, failurePolicy: failurePolicyAbort},
+		{name: "failed", summary: api.TaskGroupSummary{Failed: 1}},
+		{name: "failed with abort", summary: api.TaskGroupSummary{Failed: 1}, failurePolicy: failurePolicyAbort, expectedDeleted: true, expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newTestNomad(t, map[string]any{
+				"PUT /v1/job/warm/dispatch":           api.JobDispatchResponse{DispatchedJobID: "warm/dispatch-1"},
+				"GET /v1/job/warm/dispatch-1":         api.Job{Status: &dead},
+				"GET /v1/job/warm/dispatch-1/summary": api.JobSummary{Summary: map[string]api.TaskGroupSummary{"warm": tc.summary}},
+			})
+			var deleted bool
+			compute := newTestServiceClient(t, map[string]any{
+				"DELETE /servers/server-1": func(*http.Request) any {
+					deleted = true
+					return nil
+				},
+			})
+			jobs, err := newNomadJobs(client, map[string]string{
+				configKeyPostJoinJob:      "warm",
+				configKeyJobFailurePolicy: tc.failurePolicy,
+			}, hclog.NewNullLogger())
+			assert.NoError(t, err)
+
+			p := &TargetPlugin{
+				logger:        hclog.NewNullLogger(),
+				osClients:     &osClients{computeClient: compute, networkClient: newTestServiceClient(t, map[string]any{"GET /floatingips": map[string]any{"floatingips": []any{}}})},
+				nomadClient:   client,
+				actionTimeout: 10 * time.Second,
+			}
+			common := &commonCreateData{pool: "workers", jobs: jobs}
+			err = p.runPostJoinJob(context.Background(), common, &api.NodeListStub{ID: "node-1"}, "server-1", "pool-1")
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+			} else {
+				assert.NoError(t, err, tc.name)
+			}
+			assert.Equal(t, tc.expectedDeleted, deleted, tc.name)
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/gophercloud/v2/openstack/containerinfra/v1/clusters"
+	"github.com/gophercloud/gophercloud/v2/openstack/containerinfra/v1/nodegroups"
+	"github.com/gophercloud/gophercloud/v2/openstack/orchestration/v1/stackresources"
+	"github.com/gophercloud/gophercloud/v2/openstack/orchestration/v1/stacks"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+const (
+	defaultMagnumNodeGroup     = "default-worker"
+	defaultMagnumStackResource = "kube_minions"
+
+	// node groups are available since 1.9
+	containerInfraMicroversion = "1.10"
+)
+
+// newContainerInfraV1 creates the Magnum client. gophercloud names the service
+// type used for the microversion header after the catalog type, but Magnum
+// expects container-infra.
+func newContainerInfraV1(provider *gophercloud.ProviderClient, eo gophercloud.EndpointOpts) (*gophercloud.ServiceClient, error) {
+	client, err := openstack.NewContainerInfraV1(provider, eo)
+	if err != nil {
+		return nil, err
+	}
+	client.Type = "container-infra"
+	client.Microversion = containerInfraMicroversion
+	return client, nil
+}
+
+// magnumNodeGroup holds the node group being scaled and the cluster it belongs to.
+type magnumNodeGroup struct {
+	clusterID string
+	nodeGroup *nodegroups.NodeGroup
+}
+
+func (t *TargetPlugin) getMagnumNodeGroup(ctx context.Context, config map[string]string) (*magnumNodeGroup, error) {
+	if t.containerInfraClient == nil {
+		return nil, fmt.Errorf("container infra service is not available")
+	}
+	cluster, ok := config[configKeyMagnumCluster]
+	if !ok || cluster == "" {
+		return nil, fmt.Errorf("required config param %s not found", configKeyMagnumCluster)
+	}
+	name := defaultMagnumNodeGroup
+	if v, ok := config[configKeyMagnumNodeGroup]; ok && v != "" {
+		name = v
+	}
+
+	c, err := clusters.Get(ctx, t.containerInfraClient, cluster).Extract()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster %s: %w", cluster, err)
+	}
+	ng, err := nodegroups.Get(ctx, t.containerInfraClient, c.UUID, name).Extract()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node group %s: %w", name, err)
+	}
+	return &magnumNodeGroup{clusterID: c.UUID, nodeGroup: ng}, nil
+}
+
+func (t *TargetPlugin) scaleMagnum(ctx context.Context, desired int64, config map[string]string) (string, error) {
+	mng, err := t.getMagnumNodeGroup(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	current := int64(mng.nodeGroup.NodeCount)
+	auditFromContext(ctx).addCount(current)
+
+	log := t.logger.With("mode", modeMagnum, "cluster", mng.clusterID, "nodegroup", mng.nodeGroup.Name)
+
+	diff, direction := t.calculateDirection(current, desired)
+	switch direction {
+	case "in":
+		return direction, t.scaleInMagnum(ctx, mng, diff, config)
+	case "out":
+		if err := t.allowScaleOut(ctx); err != nil {
+			return "", err
+		}
+		log.Debug("resizing node group", "current_count", current, "desired_count", desired)
+		err := t.auditScaleOut(ctx, func() ([]string, error) {
+			return t.nodeGroupServerIDs(ctx, mng, config)
+		}, func() error {
+			return t.resizeNodeGroup(ctx, mng, int(desired), nil)
+		})
+		if err != nil {
+			return direction, err
+		}
+		log.Info("successfully performed and verified scaling out")
+		return direction, nil
+	}
+	log.Info("scaling not required", "current_count", current, "strategy_count", desired)
+	return direction, nil
+}
+
+func (t *TargetPlugin) scaleInMagnum(ctx context.Context, mng *magnumNodeGroup, count int64, config map[string]string) error {
+	sg, err := t.nodeGroupStack(ctx, mng, config)
+	if err != nil {
+		return err
+	}
+	members, err := t.stackMembers(ctx, sg)
+	if err != nil {
+		return err
+	}
+	byRemoteID, err := t.stackRemoteIDs(ctx, members)
+	if err != nil {
+		return err
+	}
+	remoteIDs := make([]string, 0, len(byRemoteID))
+	serverIDs := make(map[string]string, len(byRemoteID))
+	for id, member := range byRemoteID {
+		remoteIDs = append(remoteIDs, id)
+		serverIDs[id] = member.serverID
+	}
+
+	hooks, err := newWebhooks(config, t.logger)
+	if err != nil {
+		return err
+	}
+	jobs, err := newNomadJobs(t.nomadClient, config, t.logger)
+	if err != nil {
+		return err
+	}
+	ids, err := t.preScaleIn(ctx, config, remoteIDs, serverIDs, int(count), hooks, jobs)
+	if err != nil {
+		return fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %v", err)
+	}
+
+	log := t.logger.With("action", "scale_in", "mode", modeMagnum, "nodegroup", mng.nodeGroup.Name, "instances", ids)
+
+	remove := make([]string, 0, len(ids))
+	for _, id := range ids {
+		remove = append(remove, byRemoteID[id.RemoteResourceID].serverID)
+	}
+
+	log.Debug("resizing node group to remove servers", "servers", remove)
+	if err := t.resizeNodeGroup(ctx, mng, mng.nodeGroup.NodeCount-len(remove), remove); err != nil {
+		return err
+	}
+	log.Info("successfully removed node group servers")
+	for _, id := range ids {
+		if err := t.serviceDeleted(ctx, hooks, config[configKeyPoolName], byRemoteID[id.RemoteResourceID].serverID, id); err != nil {
+			return err
+		}
+	}
+
+	if err := t.clusterUtils.RunPostScaleInTasks(ctx, config, ids); err != nil {
+		return fmt.Errorf("failed to perform post-scale Nomad scale in tasks: %v", err)
+	}
+
+	log.Info("successfully performed and verified scaling in")
+	return nil
+}
+
+// nodeGroupStack returns the scaling group of the stack of the node group.
+func (t *TargetPlugin) nodeGroupStack(ctx context.Context, mng *magnumNodeGroup, config map[string]string) (*stackGroup, error) {
+	if t.orchestrationClient == nil {
+		return nil, fmt.Errorf("orchestration service is not available")
+	}
+
+	// the node group servers are the members of the scaling group of its stack
+	stack, err := stacks.Find(ctx, t.orchestrationClient, mng.nodeGroup.StackID).Extract()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find stack of node group %s: %w", mng.nodeGroup.Name, err)
+	}
+	sg := &stackGroup{stack: stack, resourceName: defaultMagnumStackResource}
+	if v, ok := config[configKeyMagnumStackResource]; ok && v != "" {
+		sg.resourceName = v
+	}
+	// kube_minions is the scaling group of the Magnum Heat drivers, other drivers
+	// name it differently or don't use Heat at all
+	if _, err := stackresources.Get(ctx, t.orchestrationClient, stack.Name, stack.ID, sg.resourceName).Extract(); err != nil {
+		if isNotFound(err) {
+			return nil, fmt.Errorf("stack of node group %s has no resource %s, set %s to the scaling group of its servers",
+				mng.nodeGroup.Name, sg.resourceName, configKeyMagnumStackResource)
+		}
+		return nil, fmt.Errorf("failed to get stack resource %s: %w", sg.resourceName, err)
+	}
+	return sg, nil
+}
+
+// nodeGroupServerIDs returns the IDs of the servers of the node group.
+func (t *TargetPlugin) nodeGroupServerIDs(ctx context.Context, mng *magnumNodeGroup, config map[string]string) ([]string, error) {
+	sg, err := t.nodeGroupStack(ctx, mng, config)
+	if err != nil {
+		return nil, err
+	}
+	return t.stackServerIDs(ctx, sg)
+}
+
+// resizeNodeGroup sets the node count of the node group, removing the given
+// servers, and waits for the update to complete.
+func (t *TargetPlugin) resizeNodeGroup(ctx context.Context, mng *magnumNodeGroup, count int, remove []string) error {
+	opts := clusters.ResizeOpts{
+		NodeCount:     &count,
+		NodesToRemove: remove,
+		NodeGroup:     mng.nodeGroup.UUID,
+	}
+	if err := clusters.Resize(ctx, t.containerInfraClient, mng.clusterID, opts).Err; err != nil {
+		return fmt.Errorf("failed to resize node group %s: %w", mng.nodeGroup.Name, err)
+	}
+
+	// the status is updated asynchronously, so wait for the node group to be
+	// updated before checking it
+	previous := mng.nodeGroup.UpdatedAt
+	err := gophercloud.WaitFor(ctx, func(ctx context.Context) (bool, error) {
+		ng, err := nodegroups.Get(ctx, t.containerInfraClient, mng.clusterID, mng.nodeGroup.UUID).Extract()
+		if err != nil {
+			return false, err
+		}
+		if !ng.UpdatedAt.After(previous) || strings.HasSuffix(ng.Status, "_IN_PROGRESS") {
+			return false, nil
+		}
+		if strings.HasSuffix(ng.Status, "_FAILED") {
+			return false, fmt.Errorf("node group update finished with status %s: %s", ng.Status, ng.StatusReason)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for node group %s to be updated: %w", mng.nodeGroup.Name, err)
+	}
+	return nil
+}
+
+func (t *TargetPlugin) statusMagnum(ctx context.Context, config map[string]string) (*sdk.TargetStatus, error) {
+	mng, err := t.getMagnumNodeGroup(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	ng := mng.nodeGroup
+
+	meta := map[string]string{
+		"nodegroup_status": ng.Status,
+		"min_node_count":   fmt.Sprint(ng.MinNodeCount),
+	}
+	if ng.MaxNodeCount != nil {
+		meta["max_node_count"] = fmt.Sprint(*ng.MaxNodeCount)
+	}
+	return &sdk.TargetStatus{
+		Ready: !strings.HasSuffix(ng.Status, "_IN_PROGRESS"),
+		Count: int64(ng.NodeCount),
+		Meta:  meta,
+	}, nil
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ScaleMagnum(t *testing.T) {
+	testCases := []struct {
+		name           string
+		desired        int64
+		stackResource  string
+		expectedResize map[string]any
+		expectedDrain  []string
+		expectedErr    bool
+	}{
+		{
+			name:           "scale out",
+			desired:        5,
+			expectedResize: map[string]any{"node_count": float64(5), "nodegroup": "ng1"},
+		},
+		{
+			name:           "scale in removes the selected servers",
+			desired:        2,
+			expectedResize: map[string]any{"node_count": float64(2), "nodegroup": "ng1", "nodes_to_remove": []any{"srv-3"}},
+			expectedDrain:  []string{"srv-3"},
+		},
+		{
+			name:          "scale in without the stack resource",
+			desired:       2,
+			stackResource: "minions",
+			expectedErr:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nodeGroup := func(updated string) any {
+				return map[string]any{
+					"uuid":       "ng1",
+					"name":       "workers",
+					"node_count": 3,
+					"stack_id":   "st1",
+					"status":     "UPDATE_COMPLETE",
+					"updated_at": updated,
+				}
+			}
+			// the servers are in the nested stacks of the kube_minions members
+			var resources []map[string]any
+			for i := 1; i <= 3; i++ {
+				resources = append(resources, map[string]any{
+					"resource_name":        fmt.Sprint(i - 1),
+					"resource_type":        "file:///kubeminion.yaml",
+					"parent_resource":      defaultMagnumStackResource,
+					"physical_resource_id": fmt.Sprintf("nested-%d", i),
+				}, map[string]any{
+					"resource_name":        "kube-minion",
+					"resource_type":        resourceTypeServer,
+					"parent_resource":      fmt.Sprint(i - 1),
+					"physical_resource_id": fmt.Sprintf("srv-%d", i),
+					"links":                []map[string]string{{"rel": "stack", "href": fmt.Sprintf("http://heat/stacks/workers-%d/nested-%d", i, i)}},
+				})
+			}
+
+			var resize map[string]any
+			var gets int
+			containerInfra := newTestServiceClient(t, map[string]any{
+				"GET /clusters/nomad":                 map[string]any{"uuid": "c1"},
+				"GET /clusters/c1/nodegroups/workers": nodeGroup("2024-01-01T00:00:00Z"),
+				"POST /clusters/c1/actions/resize": func(r *http.Request) any {
+					assert.NoError(t, json.NewDecoder(r.Body).Decode(&resize))
+					return map[string]any{"uuid": "c1"}
+				},
+				"GET /clusters/c1/nodegroups/ng1": func(*http.Request) any {
+					// the update isn't visible right away
+					gets++
+					if gets == 1 {
+						return nodeGroup("2024-01-01T00:00:00Z")
+					}
+					return nodeGroup("2024-02-01T00:00:00Z")
+				},
+			})
+			orchestration := newTestServiceClient(t, map[string]any{
+				"GET /stacks/st1": map[string]any{"stack": map[string]any{"id": "st1", "stack_name": "nomad-workers"}},
+				"GET /stacks/nomad-workers/st1/resources/" + defaultMagnumStackResource: map[string]any{
+					"resource": map[string]any{"resource_type": resourceTypeResourceGroup},
+				},
+				"GET /stacks/nomad-workers/st1/resources": map[string]any{"resources": resources},
+			})
+			utils, _, drained := newTestClusterUtils(t, "srv-1", "srv-2", "srv-3")
+
+			p := &TargetPlugin{
+				logger:       hclog.NewNullLogger(),
+				osClients:    &osClients{containerInfraClient: containerInfra, orchestrationClient: orchestration},
+				idMapper:     true,
+				clusterUtils: utils,
+			}
+			_, err := p.scaleMagnum(context.Background(), tc.desired, map[string]string{
+				configKeyMagnumCluster:               "nomad",
+				configKeyMagnumNodeGroup:             "workers",
+				configKeyMagnumStackResource:         tc.stackResource,
+				sdk.TargetConfigKeyClass:             "wrkr",
+				sdk.TargetConfigNodeSelectorStrategy: sdk.TargetNodeSelectorStrategyNewestCreateIndex,
+			})
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+			} else {
+				assert.NoError(t, err, tc.name)
+			}
+			assert.Equal(t, tc.expectedResize, resize, tc.name)
+			assert.Equal(t, tc.expectedDrain, drained(), tc.name)
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package plugin
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	configKeyMetricsAddress = "metrics_address"
+	configKeyStatsdAddress  = "statsd_address"
+
+	metricsPath   = "/metrics"
+	metricsPrefix = "nomad_nova_autoscaler_"
+
+	metricPhaseDuration = metricsPrefix + "phase_duration_seconds"
+	metricAPIRequests   = metricsPrefix + "api_requests_total"
+	metricAPIErrors     = metricsPrefix + "api_errors_total"
+	metricServers       = metricsPrefix + "servers"
+	metricCacheLookups  = metricsPrefix + "cache_lookups_total"
+)
+
+// the phases of the creation and deletion of the servers whose duration is
+// measured
+const (
+	phaseCreate       = "create"
+	phaseWaitActive   = "wait_active"
+	phaseFloatingIP   = "floating_ip"
+	phaseLoadBalancer = "loadbalancer"
+	phaseDNS          = "dns"
+	phaseJoin         = "join"
+	phaseJob          = "job"
+	phaseDrain        = "drain"
+	phaseStop         = "stop"
+	phaseDelete       = "delete"
+)
+
+type metricType string
+
+const (
+	metricCounter metricType = "counter"
+	metricGauge   metricType = "gauge"
+	metricSummary metricType = "summary"
+)
+
+var metricDescs = map[string]struct {
+	kind metricType
+	help string
+}{
+	metricPhaseDuration: {metricSummary, "Duration of the phases of the creation and deletion of servers."},
+	metricAPIRequests:   {metricCounter, "OS API requests sent, by service, method and status code."},
+	metricAPIErrors:     {metricCounter, "OS API requests that failed, by service and status code."},
+	metricServers:       {metricGauge, "Servers of the pools, by status and availability zone."},
+	metricCacheLookups:  {metricCounter, "Lookups of the cached image, flavor and network IDs, by result."},
+}
+
+// pluginMetrics are the metrics of all the plugins served by this binary.
+var pluginMetrics = newMetrics()
+
+type seriesKey struct {
+	name   string
+	labels string
+}
+
+type summaryValue struct {
+	count int64
+	sum   float64
+}
+
+// metrics keeps the values of the plugin metrics to serve them in the
+// Prometheus text format, and sends them to statsd if configured.
+type metrics struct {
+	lock      sync.Mutex
+	counters  map[seriesKey]float64
+	gauges    map[seriesKey]float64
+	summaries map[seriesKey]*summaryValue
+	endpoints map[string]string // service endpoint URL to service name
+
+	address string
+	server  *http.Server
+	statsd  net.Conn
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		counters:  make(map[seriesKey]float64),
+		gauges:    make(map[seriesKey]float64),
+		summaries: make(map[seriesKey]*summaryValue),
+		endpoints: make(map[string]string),
+	}
+}
+
+// configure starts serving the metrics in the address set in the config, and
+// sending them to statsd, replacing the previous settings.
+func (m *metrics) configure(config map[string]string, logger hclog.Logger) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	address := config[configKeyMetricsAddress]
+	if address != m.address {
+		if m.server != nil {
+			_ = m.server.Close()
+			m.server = nil
+		}
+		m.address = ""
+		if address != "" {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %v", configKeyMetricsAddress, err)
+			}
+			mux := http.NewServeMux()
+			mux.HandleFunc(metricsPath, m.serveHTTP)
+			m.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+			m.address = address
+			go func(server *http.Server) {
+				if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+					logger.Error("failed to serve metrics", "error", err)
+				}
+			}(m.server)
+			logger.Info("serving metrics", "address", listener.Addr().String(), "path", metricsPath)
+		}
+	}
+
+	if m.statsd != nil {
+		m.statsd.Close()
+		m.statsd = nil
+	}
+	if address := config[configKeyStatsdAddress]; address != "" {
+		conn, err := net.Dial("udp", address)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %v", configKeyStatsdAddress, err)
+		}
+		m.statsd = conn
+	}
+	return nil
+}
+
+// registerEndpoint sets the service name used in the metrics of the requests
+// sent to the endpoint.
+func (m *metrics) registerEndpoint(endpoint, service string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.endpoints[endpoint] = service
+}
+
+// service returns the name of the service of the request URL, the one with the
+// longest matching endpoint.
+func (m *metrics) service(url string) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	service, length := "unknown", 0
+	for endpoint, name := range m.endpoints {
+		if len(endpoint) > length && strings.HasPrefix(url, endpoint) {
+			service, length = name, len(endpoint)
+		}
+	}
+	return service
+}
+
+// observePhase records the duration of a phase of the creation or deletion of
+// a server of the pool since start.
+func (m *metrics) observePhase(pool, phase string, start time.Time) {
+	d := time.Since(start)
+	kvs := []string{"pool", pool, "phase", phase}
+	key := seriesKey{metricPhaseDuration, labels(kvs...)}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.summaries[key]
+	if !ok {
+		s = &summaryValue{}
+		m.summaries[key] = s
+	}
+	s.count++
+	s.sum += d.Seconds()
+	m.sendStatsd(metricPhaseDuration, strconv.FormatInt(d.Milliseconds(), 10), "ms", kvs...)
+}
+
+// observeRequest counts a request sent to an OS API. The code is empty if no
+// response was received.
+func (m *metrics) observeRequest(service, method, code string) {
+	if code == "" {
+		code = "error"
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.incr(metricAPIRequests, "service", service, "method", method, "code", code)
+	if code == "error" || code >= "400" {
+		m.incr(metricAPIErrors, "service", service, "code", code)
+	}
+}
+
+// observeCache counts a lookup of the cache, hit or not.
+func (m *metrics) observeCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.incr(metricCacheLookups, "cache", cache, "result", result)
+}
+
+// setPoolServers replaces the number of servers of the pool, by status and
+// availability zone.
+func (m *metrics) setPoolServers(pool string, counts map[[2]string]int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	prefix := labels("pool", pool) + ","
+	for key := range m.gauges {
+		if key.name == metricServers && strings.HasPrefix(key.labels, prefix) {
+			delete(m.gauges, key)
+		}
+	}
+	for k, count := range counts {
+		kvs := []string{"pool", pool, "status", k[0], "az", k[1]}
+		m.gauges[seriesKey{metricServers, labels(kvs...)}] = float64(count)
+		m.sendStatsd(metricServers, strconv.Itoa(count), "g", kvs...)
+	}
+}
+
+func (m *metrics) incr(name string, kvs ...string) {
+	m.counters[seriesKey{name, labels(kvs...)}]++
+	m.sendStatsd(name, "1", "c", kvs...)
+}
+
+// sendStatsd sends the value to statsd, with the labels as DogStatsD tags.
+func (m *metrics) sendStatsd(name, value, kind string, kvs ...string) {
+	if m.statsd == nil {
+		return
+	}
+	line := name + ":" + value + "|" + kind
+	var tags []string
+	for i := 0; i+1 < len(kvs); i += 2 {
+		tags = append(tags, kvs[i]+":"+kvs[i+1])
+	}
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	_, _ = m.statsd.Write([]byte(line))
+}
+
+// serveHTTP writes the metrics in the Prometheus text format.
+func (m *metrics) serveHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(m.format()))
+}
+
+func (m *metrics) format() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	lines := make(map[string][]string)
+	for key, v := range m.counters {
+		lines[key.name] = append(lines[key.name], sample(key.name, key.labels, v))
+	}
+	for key, v := range m.gauges {
+		lines[key.name] = append(lines[key.name], sample(key.name, key.labels, v))
+	}
+	for key, s := range m.summaries {
+		lines[key.name] = append(lines[key.name],
+			sample(key.name+"_sum", key.labels, s.sum),
+			sample(key.name+"_count", key.labels, float64(s.count)))
+	}
+
+	var b strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(lines)) {
+		desc := metricDescs[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, desc.help, name, desc.kind)
+		slices.Sort(lines[name])
+		for _, line := range lines[name] {
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+func sample(name, labels string, value float64) string {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	return name + " " + strconv.FormatFloat(value, 'g', -1, 64) + "\n"
+}
+
+// labelValueEscaper escapes the label values as the Prometheus text format
+// expects, that only escapes the backslash, double quote and line feed.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats the label name and value pairs.
+func labels(kvs ...string) string {
+	parts := make([]string, 0, len(kvs)/2)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		parts = append(parts, kvs[i]+`="`+labelValueEscaper.Replace(kvs[i+1])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+// metricsTransport counts the requests sent to the OS APIs.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (mt *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := mt.next.RoundTrip(req)
+	code := ""
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	pluginMetrics.observeRequest(pluginMetrics.service(req.URL.String()), req.Method, code)
+	return resp, err
+}
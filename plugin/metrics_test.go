@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Metrics(t *testing.T) {
+	m := newMetrics()
+	m.registerEndpoint("https://cloud.example.com/compute/", "compute")
+	m.registerEndpoint("https://cloud.example.com/", "identity")
+	assert.Equal(t, "compute", m.service("https://cloud.example.com/compute/v2.1/servers"))
+	assert.Equal(t, "identity", m.service("https://cloud.example.com/v3/auth/tokens"))
+	assert.Equal(t, "unknown", m.service("https://other.example.com/"))
+
+	m.observeRequest("compute", http.MethodPost, "202")
+	m.observeRequest("compute", http.MethodGet, "503")
+	m.observeRequest("compute", http.MethodGet, "")
+	m.observeCache("image", false)
+	m.observeCache("image", true)
+	m.observePhase("workers", phaseCreate, time.Now().Add(-2*time.Second))
+	m.setPoolServers("workers", map[[2]string]int{{"ACTIVE", "az1"}: 2, {"BUILD", "az2"}: 1})
+	m.setPoolServers("workers", map[[2]string]int{{"ACTIVE", "az1"}: 3})
+
+	out := m.format()
+	assert.Contains(t, out, "# TYPE nomad_nova_autoscaler_api_requests_total counter\n")
+	assert.Contains(t, out, `nomad_nova_autoscaler_api_requests_total{service="compute",method="POST",code="202"} 1`)
+	assert.Contains(t, out, `nomad_nova_autoscaler_api_errors_total{service="compute",code="503"} 1`)
+	assert.Contains(t, out, `nomad_nova_autoscaler_api_errors_total{service="compute",code="error"} 1`)
+	assert.NotContains(t, out, `nomad_nova_autoscaler_api_errors_total{service="compute",code="202"}`)
+	assert.Contains(t, out, `nomad_nova_autoscaler_cache_lookups_total{cache="image",result="hit"} 1`)
+	assert.Contains(t, out, `nomad_nova_autoscaler_phase_duration_seconds_count{pool="workers",phase="create"} 1`)
+	assert.Contains(t, out, `nomad_nova_autoscaler_servers{pool="workers",status="ACTIVE",az="az1"} 3`)
+	assert.NotContains(t, out, `status="BUILD"`)
+
+	rec := httptest.NewRecorder()
+	m.serveHTTP(rec, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	assert.Equal(t, out, rec.Body.String())
+}
+
+func Test_Labels(t *testing.T) {
+	testCases := []struct {
+		name     string
+		kvs      []string
+		expected string
+	}{
+		{name: "plain", kvs: []string{"pool", "workers", "az", "az1"}, expected: `pool="workers",az="az1"`},
+		{name: "escaped", kvs: []string{"pool", "a\\b\"c\nd"}, expected: `pool="a\\b\"c\nd"`},
+		{name: "non ascii", kvs: []string{"pool", "wörkers\tü"}, expected: "pool=\"wörkers\tü\""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, labels(tc.kvs...), tc.name)
+		})
+	}
+}
@@ -0,0 +1,572 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+)
+
+const (
+	configKeyJoinTimeout        = "join_timeout"
+	configKeyJoinGracePeriod    = "join_grace_period"
+	configKeyReconcileNodes     = "reconcile_nodes"
+	configKeyReconcileInterval  = "reconcile_interval"
+	configKeyReconcileMaxDelete = "reconcile_max_deletes"
+	configKeyPublishNodeMeta    = "publish_node_meta"
+
+	defaultJoinGracePeriod    = 10 * time.Minute
+	defaultReconcileInterval  = 5 * time.Minute
+	defaultReconcileMaxDelete = 1
+)
+
+// the dynamic metadata of the Nomad nodes with the identity of their server
+const (
+	nodeMetaServerID = "nova.server_id"
+	nodeMetaAZ       = "nova.az"
+	nodeMetaFlavor   = "nova.flavor"
+	nodeMetaImage    = "nova.image"
+)
+
+// waitForJoin waits for the node of the new server to join the cluster within
+// the join timeout, publishing the server meta in it if enabled. The server is
+// deleted if it doesn't join or the meta can't be published, so it isn't left
+// in the pool without a node it can be mapped to.
+func (t *TargetPlugin) waitForJoin(ctx context.Context, common *commonCreateData, serverID, serverName, az string) (*api.NodeListStub, error) {
+	joinCtx, cancel := context.WithTimeout(ctx, common.joinTimeout)
+	defer cancel()
+
+	phaseCtx, end := startPhase(joinCtx, common.pool, phaseJoin)
+	node, err := t.waitForNode(phaseCtx, common.nodeClass, serverID, serverName)
+	end(err)
+	if err != nil {
+		t.logger.Warn("server node didn't join, deleting server", "server", serverID, "join_timeout", common.joinTimeout, "error", err)
+		t.deleteFailedServer(ctx, common.pool, serverID)
+		return nil, fmt.Errorf("node of server %s didn't join within %s: %w", serverID, common.joinTimeout, err)
+	}
+	t.logger.Debug("server node joined", "server", serverID, "node_id", node.ID)
+
+	if common.publishNodeMeta {
+		if err := t.publishNodeMeta(ctx, node, serverID, az, common.flavorID, common.imageID); err != nil {
+			t.logger.Warn("failed to publish server meta in node, deleting server", "server", serverID, "node_id", node.ID, "error", err)
+			t.deleteFailedServer(ctx, common.pool, serverID)
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// undrainNodes makes the drained nodes eligible again when their servers
+// aren't removed.
+func (t *TargetPlugin) undrainNodes(ctx context.Context, ids []scaleutils.NodeResourceID) {
+	for _, id := range ids {
+		if _, err := t.nomadClient.Nodes().UpdateDrain(id.NomadNodeID, nil, true, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+			t.logger.Warn("failed to make drained node eligible", "node_id", id.NomadNodeID, "error", err)
+			continue
+		}
+		t.logger.Info("made drained node eligible", "node_id", id.NomadNodeID)
+	}
+}
+
+// waitForNode waits for the Nomad node of the server to be ready and eligible.
+// Only the nodes of the class are checked, if set. When the nodes are mapped to
+// the servers with the published nova.server_id meta, the nodes that don't have
+// it yet are matched with the server name.
+func (t *TargetPlugin) waitForNode(ctx context.Context, nodeClass, serverID, serverName string) (*api.NodeListStub, error) {
+	remoteID := t.remoteID(serverID, serverName)
+	joined := func(n *api.NodeListStub) bool {
+		return n.Status == api.NodeStatusReady && n.SchedulingEligibility == api.NodeSchedulingEligible
+	}
+
+	var node *api.NodeListStub
+	err := gophercloud.WaitFor(ctx, func(ctx context.Context) (bool, error) {
+		nodes, unmapped, err := t.listClassNodes(ctx, nodeClass)
+		if err != nil {
+			return false, err
+		}
+		if n, ok := nodes[remoteID]; ok && joined(n) {
+			node = n
+			return true, nil
+		}
+		if t.nodeNameLookup == nil {
+			return false, nil
+		}
+		for _, n := range unmapped {
+			if !joined(n) {
+				continue
+			}
+			if entry, ok := t.nodeIDs.get(n); ok && entry.name == serverName {
+				node = n
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	return node, err
+}
+
+// publishNodeMeta writes the identity of the server in the dynamic metadata of
+// its Nomad node, so it can be mapped to the server with the nova.server_id
+// meta and jobs can constrain on them.
+func (t *TargetPlugin) publishNodeMeta(ctx context.Context, node *api.NodeListStub, serverID, az, flavorID, imageID string) error {
+	req := &api.NodeMetaApplyRequest{
+		NodeID: node.ID,
+		Meta: map[string]*string{
+			nodeMetaServerID: &serverID,
+			nodeMetaAZ:       &az,
+			nodeMetaFlavor:   &flavorID,
+			nodeMetaImage:    &imageID,
+		},
+	}
+	if _, err := t.nomadClient.Nodes().Meta().Apply(req, (&api.QueryOptions{}).WithContext(ctx)); err != nil {
+		return fmt.Errorf("failed to publish the meta of node %s: %v", node.ID, err)
+	}
+	if t.idMapper {
+		t.nodeIDs.set(node.ID, serverID)
+	}
+	t.logger.Debug("published server meta in node", "server", serverID, "node_id", node.ID)
+	return nil
+}
+
+// remoteID returns the ID the Nomad node of the server is mapped to, its ID or
+// name depending on the attribute used.
+func (t *TargetPlugin) remoteID(serverID, serverName string) string {
+	if t.idMapper {
+		return serverID
+	}
+	return serverName
+}
+
+// unmappedNodeTTL is how long the nodes without a remote ID are cached if they
+// aren't modified meanwhile.
+const unmappedNodeTTL = time.Minute
+
+// nodeRemoteIDs caches the remote IDs of the Nomad nodes, so their attributes
+// are only read once. The nodes without one are cached until they're modified,
+// as it can be set later like the published meta, or the TTL expires.
+type nodeRemoteIDs struct {
+	lock sync.Mutex
+	ids  map[string]nodeRemoteIDEntry
+}
+
+type nodeRemoteIDEntry struct {
+	remoteID string
+
+	// name is the server name of the nodes without a remote ID, if they're
+	// also matched by name
+	name        string
+	modifyIndex uint64
+	expires     time.Time
+}
+
+func newNodeRemoteIDs() *nodeRemoteIDs {
+	return &nodeRemoteIDs{ids: make(map[string]nodeRemoteIDEntry)}
+}
+
+func (c *nodeRemoteIDs) get(stub *api.NodeListStub) (nodeRemoteIDEntry, bool) {
+	if c == nil {
+		return nodeRemoteIDEntry{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.ids[stub.ID]
+	if ok && entry.remoteID == "" && (entry.modifyIndex != stub.ModifyIndex || !time.Now().Before(entry.expires)) {
+		return nodeRemoteIDEntry{}, false
+	}
+	return entry, ok
+}
+
+func (c *nodeRemoteIDs) set(nodeID, remoteID string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ids[nodeID] = nodeRemoteIDEntry{remoteID: remoteID}
+}
+
+func (c *nodeRemoteIDs) setUnmapped(stub *api.NodeListStub, name string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ids[stub.ID] = nodeRemoteIDEntry{name: name, modifyIndex: stub.ModifyIndex, expires: time.Now().Add(unmappedNodeTTL)}
+}
+
+// retain removes the nodes that aren't listed anymore, as they were garbage
+// collected or purged.
+func (c *nodeRemoteIDs) retain(stubs []*api.NodeListStub) {
+	if c == nil {
+		return
+	}
+	listed := make(map[string]struct{}, len(stubs))
+	for _, stub := range stubs {
+		listed[stub.ID] = struct{}{}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for nodeID := range c.ids {
+		if _, ok := listed[nodeID]; !ok {
+			delete(c.ids, nodeID)
+		}
+	}
+}
+
+// classNodes returns the Nomad nodes of the class by remote ID, or all of them
+// if no class is set. If a server has several nodes, the ready one is
+// returned.
+func (t *TargetPlugin) classNodes(ctx context.Context, nodeClass string) (map[string]*api.NodeListStub, error) {
+	nodes, _, err := t.listClassNodes(ctx, nodeClass)
+	return nodes, err
+}
+
+// listClassNodes returns the nodes of the class by remote ID, and the ones
+// without it.
+func (t *TargetPlugin) listClassNodes(ctx context.Context, nodeClass string) (map[string]*api.NodeListStub, []*api.NodeListStub, error) {
+	q := (&api.QueryOptions{}).WithContext(ctx)
+	stubs, _, err := t.nomadClient.Nodes().List(q)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list Nomad nodes: %v", err)
+	}
+	t.nodeIDs.retain(stubs)
+
+	nodes := make(map[string]*api.NodeListStub)
+	var unmapped []*api.NodeListStub
+	for _, stub := range stubs {
+		if nodeClass != "" && stub.NodeClass != nodeClass {
+			continue
+		}
+		remoteID, err := t.nodeRemoteID(stub, q)
+		if err != nil {
+			return nil, nil, err
+		}
+		if remoteID == "" {
+			unmapped = append(unmapped, stub)
+			continue
+		}
+		if current, ok := nodes[remoteID]; ok && current.Status == api.NodeStatusReady {
+			continue
+		}
+		nodes[remoteID] = stub
+	}
+	return nodes, unmapped, nil
+}
+
+// nodeRemoteID returns the remote ID of the node, or an empty one if its
+// attributes don't have it. The server name of the latter is cached too when
+// the nodes are also matched by name.
+func (t *TargetPlugin) nodeRemoteID(stub *api.NodeListStub, q *api.QueryOptions) (string, error) {
+	if entry, ok := t.nodeIDs.get(stub); ok {
+		return entry.remoteID, nil
+	}
+	node, _, err := t.nomadClient.Nodes().Info(stub.ID, q)
+	if err != nil {
+		return "", fmt.Errorf("failed to get Nomad node %s: %v", stub.ID, err)
+	}
+	if id, err := t.clusterUtils.ClusterNodeIDLookupFunc(node); err == nil && id != "" {
+		t.nodeIDs.set(stub.ID, id)
+		return id, nil
+	}
+
+	var name string
+	if t.nodeNameLookup != nil {
+		name, _ = t.nodeNameLookup(node)
+	}
+	t.nodeIDs.setUnmapped(stub, name)
+	return "", nil
+}
+
+// poolMembership counts the ACTIVE servers of the pool by the status of their
+// Nomad node.
+type poolMembership struct {
+	joined  int64 // the node is ready
+	pending int64 // there's no node yet, or it's initializing
+	missing int64 // the node is down or disconnected
+
+	// longPending are the pending servers created longer than the grace
+	// period ago.
+	longPending int64
+}
+
+func (m *poolMembership) add(other *poolMembership) {
+	m.joined += other.joined
+	m.pending += other.pending
+	m.missing += other.missing
+	m.longPending += other.longPending
+}
+
+// poolMembership matches the servers of the pool with the Nomad nodes.
+func (t *TargetPlugin) poolMembership(ctx context.Context, pool string, nodes map[string]*api.NodeListStub, gracePeriod time.Duration) (*poolMembership, error) {
+	serverList, err := t.listPoolServers(ctx, pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Nova servers: %v", err)
+	}
+
+	m := &poolMembership{}
+	for _, server := range serverList {
+		if server.Status != "ACTIVE" {
+			continue
+		}
+		node, ok := nodes[t.remoteID(server.ID, server.Name)]
+		switch {
+		case ok && node.Status == api.NodeStatusReady:
+			m.joined++
+		case ok && node.Status != api.NodeStatusInit:
+			m.missing++
+		default:
+			m.pending++
+			if time.Since(server.Created) > gracePeriod {
+				m.longPending++
+				t.logger.Warn("server node hasn't joined within the grace period", "server", server.ID, "name", server.Name, "created", server.Created)
+			}
+		}
+	}
+	return m, nil
+}
+
+// checkMembership adds the counts of the pool servers by the status of their
+// Nomad node to the status meta. The pool isn't ready while any of them has
+// been pending to join longer than the grace period. It's only checked if the
+// grace period is set.
+func (t *TargetPlugin) checkMembership(ctx context.Context, config map[string]string, plugins []*TargetPlugin, status *sdk.TargetStatus) error {
+	if config[configKeyJoinGracePeriod] == "" {
+		return nil
+	}
+	gracePeriod, err := joinGracePeriod(config)
+	if err != nil {
+		return err
+	}
+	nodes, err := t.classNodes(ctx, config[sdk.TargetConfigKeyClass])
+	if err != nil {
+		return err
+	}
+
+	total := &poolMembership{}
+	for _, p := range plugins {
+		m, err := p.poolMembership(ctx, config[configKeyPoolName], nodes, gracePeriod)
+		if err != nil {
+			return err
+		}
+		total.add(m)
+	}
+
+	status.Meta["nodes_joined"] = strconv.FormatInt(total.joined, 10)
+	status.Meta["nodes_pending"] = strconv.FormatInt(total.pending, 10)
+	status.Meta["nodes_missing"] = strconv.FormatInt(total.missing, 10)
+	if total.longPending > 0 {
+		status.Ready = false
+	}
+	return nil
+}
+
+// joinGracePeriod returns how long the nodes of new servers have to join. It
+// must be longer than a scale-out waits for them to join and run the
+// post_join_job, or the servers it's still waiting on would be reported and
+// deleted.
+func joinGracePeriod(config map[string]string) (time.Duration, error) {
+	grace := defaultJoinGracePeriod
+	if v, ok := config[configKeyJoinGracePeriod]; ok && v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %s: %v", configKeyJoinGracePeriod, err)
+		}
+		grace = d
+	}
+
+	var wait time.Duration
+	if v, ok := config[configKeyJoinTimeout]; ok && v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %s: %v", configKeyJoinTimeout, err)
+		}
+		wait = d
+	}
+	if config[configKeyPostJoinJob] != "" {
+		jobTimeout := defaultJobTimeout
+		if v, ok := config[configKeyJobTimeout]; ok && v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return 0, fmt.Errorf("failed to parse %s: %v", configKeyJobTimeout, err)
+			}
+			jobTimeout = d
+		}
+		wait += jobTimeout
+	}
+	if grace <= wait {
+		return 0, fmt.Errorf("%s (%s) must be longer than the %s and the %s of the %s (%s)",
+			configKeyJoinGracePeriod, grace, configKeyJoinTimeout, configKeyJobTimeout, configKeyPostJoinJob, wait)
+	}
+	return grace, nil
+}
+
+// reconcileNodes purges the down Nomad nodes of the class whose server isn't
+// in the pool anymore, and deletes the ACTIVE servers of the pool that still
+// have no node after the join grace period. The node class must only have
+// the nodes of the pool. It runs at most once per reconcile interval.
+//
+// As a wrong node class or mapping attribute would make every server look like
+// it has no node, no server is deleted when most nodes of the class don't map
+// to a pool server, or while some live node has no remote ID yet, and at most
+// reconcile_max_deletes servers are deleted every time.
+func (t *TargetPlugin) reconcileNodes(ctx context.Context, config map[string]string, plugins []*TargetPlugin) {
+	if config[configKeyReconcileNodes] == "" {
+		return
+	}
+	pool, nodeClass := config[configKeyPoolName], config[sdk.TargetConfigKeyClass]
+	log := t.logger.With("action", "reconcile_nodes", "pool_name", pool)
+	if nodeClass == "" {
+		log.Warn("nodes can't be reconciled without node_class")
+		return
+	}
+
+	interval := defaultReconcileInterval
+	if v, ok := config[configKeyReconcileInterval]; ok && v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Warn("failed to parse reconcile_interval", "error", err)
+			return
+		}
+		interval = d
+	}
+	maxDeletes := defaultReconcileMaxDelete
+	if v, ok := config[configKeyReconcileMaxDelete]; ok && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Warn("invalid value for reconcile_max_deletes", "value", v)
+			return
+		}
+		maxDeletes = n
+	}
+	if !t.reconciles.due(pool, interval) {
+		return
+	}
+	gracePeriod, err := joinGracePeriod(config)
+	if err != nil {
+		log.Warn("invalid join_grace_period", "error", err)
+		return
+	}
+
+	nodes, unmapped, err := t.listClassNodes(ctx, nodeClass)
+	if err != nil {
+		log.Warn("failed to list nodes", "error", err)
+		return
+	}
+
+	remoteIDs := make(map[string]struct{})
+	var noNode []poolServer
+	var total int
+	for _, p := range plugins {
+		serverList, err := p.listPoolServers(ctx, pool)
+		if err != nil {
+			// without all the servers the nodes of the missing ones can't be told apart
+			log.Warn("failed to list pool servers", "error", err)
+			return
+		}
+		total += len(serverList)
+		for _, server := range serverList {
+			remoteID := p.remoteID(server.ID, server.Name)
+			remoteIDs[remoteID] = struct{}{}
+			if _, ok := nodes[remoteID]; !ok && server.Status == "ACTIVE" && time.Since(server.Created) >= gracePeriod {
+				noNode = append(noNode, poolServer{plugin: p, server: server})
+			}
+		}
+	}
+
+	var mapped, unresolved int
+	for remoteID := range nodes {
+		if _, ok := remoteIDs[remoteID]; ok {
+			mapped++
+		}
+	}
+	for _, node := range unmapped {
+		if node.Status != api.NodeStatusDown {
+			unresolved++
+		}
+	}
+	switch {
+	case len(noNode) == 0:
+	case mapped == 0 || mapped*2 < len(nodes):
+		log.Warn("most nodes of the class don't map to a pool server, not deleting the servers without node",
+			"nodes", len(nodes), "mapped_nodes", mapped, "servers_without_node", len(noNode))
+	case unresolved > 0:
+		log.Info("some nodes of the class have no remote ID yet, not deleting the servers without node",
+			"unresolved_nodes", unresolved, "servers_without_node", len(noNode))
+	default:
+		if len(noNode) > maxDeletes {
+			log.Warn("reached the maximum of servers deleted per reconcile", "max_deletes", maxDeletes, "remaining", len(noNode)-maxDeletes)
+			noNode = noNode[:maxDeletes]
+		}
+		t.deleteServersWithoutNode(ctx, config, total, noNode)
+	}
+
+	for remoteID, node := range nodes {
+		if _, ok := remoteIDs[remoteID]; ok || node.Status != api.NodeStatusDown {
+			continue
+		}
+		log.Info("node server doesn't exist, purging it", "node_id", node.ID, "remote_id", remoteID)
+		if _, _, err := t.nomadClient.Nodes().Purge(node.ID, (&api.QueryOptions{}).WithContext(ctx)); err != nil {
+			log.Warn("failed to purge node", "node_id", node.ID, "error", err)
+		}
+	}
+}
+
+// poolServer is a server of the pool, with the plugin of its region.
+type poolServer struct {
+	plugin *TargetPlugin
+	server customServer
+}
+
+// deleteServersWithoutNode deletes the servers of the pool whose node didn't
+// join. They're audited like a scaling action and sent to the post_delete
+// webhook, like the ones removed by the scale-ins.
+func (t *TargetPlugin) deleteServersWithoutNode(ctx context.Context, config map[string]string, total int, servers []poolServer) {
+	pool := config[configKeyPoolName]
+	log := t.logger.With("action", "reconcile_nodes", "pool_name", pool)
+	hooks, err := newWebhooks(config, t.logger)
+	if err != nil {
+		log.Warn("failed to set up the webhooks", "error", err)
+	}
+
+	var record *auditRecord
+	if t.audit != nil {
+		record = newAuditRecord(modeServers, pool, sdk.ScalingAction{
+			Count:     int64(total - len(servers)),
+			Direction: sdk.ScaleDirectionDown,
+			Reason:    "reconcile_nodes: servers without node after the join grace period",
+		})
+		record.addCount(int64(total))
+	}
+
+	// the deletions go on when the status check times out
+	ctx = context.WithoutCancel(ctx)
+	var lastErr error
+	for _, ps := range servers {
+		server := ps.server
+		log.Info("server has no node after the join grace period, deleting it", "instance_id", server.ID, "name", server.Name, "created", server.Created)
+		start := time.Now()
+		deleteCtx, cancel := context.WithTimeout(ctx, t.actionTimeout)
+		err := ps.plugin.deleteServer(deleteCtx, pool, false, false, server.ID)
+		cancel()
+		if err != nil {
+			log.Warn("failed to delete server", "instance_id", server.ID, "error", err)
+			lastErr = err
+			continue
+		}
+
+		record.deleted(auditServer{ID: server.ID, Name: server.Name, AZ: server.AZ, DurationSeconds: time.Since(start).Seconds()})
+		event := webhookEvent{Event: eventPostDelete, Pool: pool, Server: webhookServer{ID: server.ID, Name: server.Name, AZ: server.AZ}}
+		if err := hooks.notify(ctx, event); err != nil {
+			log.Warn("failed to notify server deletion", "instance_id", server.ID, "error", err)
+		}
+	}
+	if record != nil {
+		t.writeAudit(record, lastErr)
+	}
+}
@@ -0,0 +1,433 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WaitForNode(t *testing.T) {
+	client := newTestNomad(t, map[string]any{
+		"GET /v1/nodes": []*api.NodeListStub{
+			{ID: "node-1", NodeClass: "wrkr", Status: api.NodeStatusReady, SchedulingEligibility: api.NodeSchedulingEligible},
+			{ID: "node-2", NodeClass: "other", Status: api.NodeStatusReady, SchedulingEligibility: api.NodeSchedulingEligible},
+			{ID: "node-3", NodeClass: "wrkr", Status: api.NodeStatusReady, SchedulingEligibility: api.NodeSchedulingEligible},
+			{ID: "node-4", NodeClass: "wrkr", Status: api.NodeStatusReady, SchedulingEligibility: api.NodeSchedulingIneligible},
+			{ID: "node-5", NodeClass: "wrkr", Status: api.NodeStatusInit},
+		},
+		"GET /v1/node/node-1": api.Node{ID: "node-1", Attributes: map[string]string{"unique.hostname": "pool-a"}},
+		"GET /v1/node/node-2": api.Node{ID: "node-2", Attributes: map[string]string{"unique.hostname": "pool-d"}},
+		"GET /v1/node/node-3": api.Node{ID: "node-3", Attributes: map[string]string{"unique.hostname": "pool-b"}},
+		"GET /v1/node/node-4": api.Node{ID: "node-4", Attributes: map[string]string{"unique.hostname": "pool-c"}},
+		"GET /v1/node/node-5": api.Node{ID: "node-5"},
+	})
+	plugin := &TargetPlugin{
+		nomadClient:  client,
+		nodeIDs:      newNodeRemoteIDs(),
+		clusterUtils: &scaleutils.ClusterScaleUtils{ClusterNodeIDLookupFunc: osNovaNodeIDMapBuilder("unique.hostname", "")},
+	}
+
+	testCases := []struct {
+		name         string
+		serverName   string
+		expectedNode string
+	}{
+		{name: "joined", serverName: "pool-b", expectedNode: "node-3"},
+		{name: "ineligible", serverName: "pool-c"},
+		{name: "other class", serverName: "pool-d"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			node, err := plugin.waitForNode(ctx, "wrkr", "", tc.serverName)
+			if tc.expectedNode == "" {
+				assert.ErrorIs(t, err, context.DeadlineExceeded, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedNode, node.ID, tc.name)
+		})
+	}
+}
+
+func Test_ClassNodes(t *testing.T) {
+	infos := 0
+	stubs := []*api.NodeListStub{
+		{ID: "node-1", NodeClass: "wrkr", Status: api.NodeStatusReady},
+		{ID: "node-2", NodeClass: "wrkr", Status: api.NodeStatusDown},
+		{ID: "node-3", NodeClass: "wrkr", Status: api.NodeStatusDown},
+		{ID: "node-4", NodeClass: "wrkr", Status: api.NodeStatusInit},
+		{ID: "node-5", NodeClass: "other", Status: api.NodeStatusReady},
+		{ID: "node-6", NodeClass: "wrkr", Status: api.NodeStatusReady},
+	}
+	client := newTestNomad(t, map[string]any{
+		"GET /v1/nodes": func(*http.Request) any { return stubs },
+		"GET /v1/node/node-1": func(*http.Request) any {
+			infos++
+			return api.Node{ID: "node-1", Meta: map[string]string{"server_id": "server-a"}}
+		},
+		"GET /v1/node/node-2": func(*http.Request) any {
+			infos++
+			return api.Node{ID: "node-2", Meta: map[string]string{"server_id": "server-a"}}
+		},
+		"GET /v1/node/node-3": func(*http.Request) any {
+			infos++
+			return api.Node{ID: "node-3", Meta: map[string]string{"server_id": "server-b"}}
+		},
+		"GET /v1/node/node-4": func(*http.Request) any {
+			infos++
+			return api.Node{ID: "node-4"}
+		},
+		"GET /v1/node/node-6": func(*http.Request) any {
+			infos++
+			return api.Node{ID: "node-6", Meta: map[string]string{"server_id": "server-c"}}
+		},
+	})
+	plugin := &TargetPlugin{
+		nomadClient:  client,
+		nodeIDs:      newNodeRemoteIDs(),
+		idMapper:     true,
+		clusterUtils: &scaleutils.ClusterScaleUtils{ClusterNodeIDLookupFunc: osNovaNodeIDMapBuilder("", "meta.server_id")},
+	}
+	// node-6 has no server ID until it's modified
+	plugin.nodeIDs.setUnmapped(stubs[5], "")
+
+	nodes, err := plugin.classNodes(context.Background(), "wrkr")
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 2)
+	assert.Equal(t, "node-1", nodes["server-a"].ID)
+	assert.Equal(t, "node-3", nodes["server-b"].ID)
+	assert.Equal(t, 4, infos)
+
+	// the nodes without a server ID are cached until they're modified
+	nodes, err = plugin.classNodes(context.Background(), "wrkr")
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 2)
+	assert.Equal(t, 4, infos)
+
+	stubs[5].ModifyIndex++
+	nodes, err = plugin.classNodes(context.Background(), "wrkr")
+	assert.NoError(t, err)
+	assert.Equal(t, "node-6", nodes["server-c"].ID)
+	assert.Equal(t, 5, infos)
+
+	// or the TTL expires
+	plugin.nodeIDs.lock.Lock()
+	entry := plugin.nodeIDs.ids["node-4"]
+	entry.expires = time.Now()
+	plugin.nodeIDs.ids["node-4"] = entry
+	plugin.nodeIDs.lock.Unlock()
+	_, err = plugin.classNodes(context.Background(), "wrkr")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, infos)
+
+	// the nodes that aren't listed anymore are removed
+	stubs = stubs[2:]
+	_, err = plugin.classNodes(context.Background(), "wrkr")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, infos)
+	plugin.nodeIDs.lock.Lock()
+	assert.NotContains(t, plugin.nodeIDs.ids, "node-1")
+	assert.NotContains(t, plugin.nodeIDs.ids, "node-2")
+	assert.Len(t, plugin.nodeIDs.ids, 3)
+	plugin.nodeIDs.lock.Unlock()
+}
+
+func Test_PublishNodeMeta(t *testing.T) {
+	var applied api.NodeMetaApplyRequest
+	client := newTestNomad(t, map[string]any{
+		"GET /v1/nodes": []*api.NodeListStub{
+			{ID: "node-1", NodeClass: "wrkr", Status: api.NodeStatusReady, SchedulingEligibility: api.NodeSchedulingEligible},
+		},
+		"GET /v1/node/node-1": api.Node{ID: "node-1", Attributes: map[string]string{"unique.hostname": "pool-a"}},
+		"POST /v1/client/metadata": func(r *http.Request) any {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&applied))
+			return api.NodeMetaResponse{}
+		},
+	})
+	plugin := &TargetPlugin{
+		logger:         hclog.NewNullLogger(),
+		nomadClient:    client,
+		nodeIDs:        newNodeRemoteIDs(),
+		idMapper:       true,
+		nodeNameLookup: osNovaNodeIDMapBuilder("unique.hostname", ""),
+		clusterUtils:   &scaleutils.ClusterScaleUtils{ClusterNodeIDLookupFunc: osNovaNodeIDMapBuilder("", "meta."+nodeMetaServerID)},
+	}
+
+	// the node is found by name until it has the server ID
+	node, err := plugin.waitForNode(context.Background(), "wrkr", "server-a", "pool-a")
+	assert.NoError(t, err)
+	assert.Equal(t, "node-1", node.ID)
+
+	assert.NoError(t, plugin.publishNodeMeta(context.Background(), node, "server-a", "az1", "flavor-1", "image-1"))
+	assert.Equal(t, "node-1", applied.NodeID)
+	meta := make(map[string]string)
+	for k, v := range applied.Meta {
+		meta[k] = *v
+	}
+	assert.Equal(t, map[string]string{
+		nodeMetaServerID: "server-a",
+		nodeMetaAZ:       "az1",
+		nodeMetaFlavor:   "flavor-1",
+		nodeMetaImage:    "image-1",
+	}, meta)
+
+	nodes, err := plugin.classNodes(context.Background(), "wrkr")
+	assert.NoError(t, err)
+	assert.Equal(t, "node-1", nodes["server-a"].ID)
+}
+
+func Test_ReconcileNodes(t *testing.T) {
+	old := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+
+	testCases := []struct {
+		name            string
+		nodes           map[string]string // the server ID meta of the nodes by ID
+		maxDeletes      string
+		expectedDeleted []string
+		expectedPurged  []string
+	}{
+		{
+			name:            "delete and purge",
+			nodes:           map[string]string{"node-a": "srv-a", "node-b": "srv-b", "node-gone": "srv-gone"},
+			expectedDeleted: []string{"srv-c"},
+			expectedPurged:  []string{"node-gone"},
+		},
+		{
+			name:            "max deletes",
+			nodes:           map[string]string{"node-a": "srv-a", "node-b": "srv-b", "node-gone": "srv-gone"},
+			maxDeletes:      "2",
+			expectedDeleted: []string{"srv-c", "srv-d"},
+			expectedPurged:  []string{"node-gone"},
+		},
+		{
+			name:           "no node maps to a server",
+			nodes:          map[string]string{"node-gone": "srv-gone"},
+			expectedPurged: []string{"node-gone"},
+		},
+		{
+			name:           "most nodes don't map to a server",
+			nodes:          map[string]string{"node-a": "srv-a", "node-gone": "srv-gone", "node-gone-2": "srv-gone-2", "node-gone-3": "srv-gone-3"},
+			expectedPurged: []string{"node-gone", "node-gone-2", "node-gone-3"},
+		},
+		{
+			name:  "unresolved node",
+			nodes: map[string]string{"node-a": "srv-a", "node-b": "srv-b", "node-new": ""},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				lock    sync.Mutex
+				deleted []string
+				purged  []string
+			)
+			var stubs []*api.NodeListStub
+			handlers := map[string]any{}
+			for nodeID, serverID := range tc.nodes {
+				status := api.NodeStatusReady
+				if strings.HasPrefix(nodeID, "node-gone") {
+					status = api.NodeStatusDown
+				}
+				stubs = append(stubs, &api.NodeListStub{ID: nodeID, NodeClass: "wrkr", Status: status})
+				meta := map[string]string{}
+				if serverID != "" {
+					meta[nodeMetaServerID] = serverID
+				}
+				handlers["GET /v1/node/"+nodeID] = api.Node{ID: nodeID, NodeClass: "wrkr", Meta: meta}
+				handlers["PUT /v1/node/"+nodeID+"/purge"] = func(*http.Request) any {
+					lock.Lock()
+					defer lock.Unlock()
+					purged = append(purged, nodeID)
+					return api.NodePurgeResponse{}
+				}
+			}
+			handlers["GET /v1/nodes"] = stubs
+
+			// srv-c and srv-d have no node after the grace period, srv-e is new
+			compute := map[string]any{
+				"GET /servers/detail": map[string]any{"servers": []map[string]any{
+					{"id": "srv-a", "name": "pool-a", "status": "ACTIVE", "created": old},
+					{"id": "srv-b", "name": "pool-b", "status": "ACTIVE", "created": old},
+					{"id": "srv-c", "name": "pool-c", "status": "ACTIVE", "created": old},
+					{"id": "srv-d", "name": "pool-d", "status": "ACTIVE", "created": old},
+					{"id": "srv-e", "name": "pool-e", "status": "ACTIVE", "created": recent},
+				}},
+			}
+			for _, id := range []string{"srv-a", "srv-b", "srv-c", "srv-d", "srv-e"} {
+				compute["DELETE /servers/"+id] = func(*http.Request) any {
+					lock.Lock()
+					defer lock.Unlock()
+					deleted = append(deleted, id)
+					return nil
+				}
+			}
+
+			var notified []string
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var event webhookEvent
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+				lock.Lock()
+				defer lock.Unlock()
+				notified = append(notified, event.Event+" "+event.Server.ID)
+			}))
+			defer hook.Close()
+			auditPath := filepath.Join(t.TempDir(), "audit.log")
+			audit, err := newAuditLog(map[string]string{"audit_log": auditPath})
+			assert.NoError(t, err)
+			defer audit.close()
+
+			p := &TargetPlugin{
+				logger:        hclog.NewNullLogger(),
+				osClients:     &osClients{computeClient: newTestServiceClient(t, compute), networkClient: newTestServiceClient(t, map[string]any{"GET /floatingips": map[string]any{"floatingips": []any{}}})},
+				nomadClient:   newTestNomad(t, handlers),
+				nodeIDs:       newNodeRemoteIDs(),
+				idMapper:      true,
+				reconciles:    newReconcileTimes(),
+				actionTimeout: 10 * time.Second,
+				audit:         audit,
+				clusterUtils:  &scaleutils.ClusterScaleUtils{ClusterNodeIDLookupFunc: osNovaNodeIDMapBuilder("", "meta."+nodeMetaServerID)},
+			}
+			p.reconcileNodes(context.Background(), map[string]string{
+				configKeyPoolName:           "workers",
+				configKeyReconcileNodes:     "true",
+				configKeyReconcileMaxDelete: tc.maxDeletes,
+				configKeyJoinGracePeriod:    "10m",
+				configKeyWebhookURL:         hook.URL,
+				sdk.TargetConfigKeyClass:    "wrkr",
+			}, []*TargetPlugin{p})
+
+			sort.Strings(purged)
+			assert.Equal(t, tc.expectedDeleted, deleted, tc.name)
+			assert.Equal(t, tc.expectedPurged, purged, tc.name)
+
+			// the deleted servers are audited and notified
+			var expectedNotified []string
+			for _, id := range tc.expectedDeleted {
+				expectedNotified = append(expectedNotified, eventPostDelete+" "+id)
+			}
+			assert.Equal(t, expectedNotified, notified, tc.name)
+			content, err := os.ReadFile(auditPath)
+			assert.NoError(t, err)
+			if tc.expectedDeleted == nil {
+				assert.Empty(t, content, tc.name)
+				return
+			}
+			var record auditRecord
+			assert.NoError(t, json.Unmarshal(content, &record))
+			assert.Equal(t, "down", record.Direction, tc.name)
+			assert.Equal(t, int64(5), *record.PreviousCount, tc.name)
+			assert.Equal(t, int64(5-len(tc.expectedDeleted)), *record.ActualCount, tc.name)
+			assert.Len(t, record.Deleted, len(tc.expectedDeleted), tc.name)
+		})
+	}
+}
+
+func Test_WaitForJoin(t *testing.T) {
+	testCases := []struct {
+		name            string
+		metaFails       bool
+		expectedDeleted bool
+		expectedErr     bool
+	}{
+		{name: "meta published"},
+		{name: "meta not published", metaFails: true, expectedDeleted: true, expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handlers := map[string]any{
+				"GET /v1/nodes": []*api.NodeListStub{
+					{ID: "node-1", NodeClass: "wrkr", Status: api.NodeStatusReady, SchedulingEligibility: api.NodeSchedulingEligible},
+				},
+				"GET /v1/node/node-1": api.Node{ID: "node-1", Attributes: map[string]string{"unique.hostname": "pool-a"}},
+			}
+			// the meta can't be written without the handler
+			if !tc.metaFails {
+				handlers["POST /v1/client/metadata"] = api.NodeMetaResponse{}
+			}
+
+			var deleted bool
+			compute := newTestServiceClient(t, map[string]any{
+				"DELETE /servers/server-a": func(*http.Request) any {
+					deleted = true
+					return nil
+				},
+			})
+			p := &TargetPlugin{
+				logger:         hclog.NewNullLogger(),
+				osClients:      &osClients{computeClient: compute, networkClient: newTestServiceClient(t, map[string]any{"GET /floatingips": map[string]any{"floatingips": []any{}}})},
+				nomadClient:    newTestNomad(t, handlers),
+				nodeIDs:        newNodeRemoteIDs(),
+				idMapper:       true,
+				actionTimeout:  10 * time.Second,
+				nodeNameLookup: osNovaNodeIDMapBuilder("unique.hostname", ""),
+				clusterUtils:   &scaleutils.ClusterScaleUtils{ClusterNodeIDLookupFunc: osNovaNodeIDMapBuilder("", "meta."+nodeMetaServerID)},
+			}
+			common := &commonCreateData{pool: "workers", nodeClass: "wrkr", joinTimeout: time.Second, publishNodeMeta: true}
+			node, err := p.waitForJoin(context.Background(), common, "server-a", "pool-a", "az1")
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+			} else {
+				assert.NoError(t, err, tc.name)
+				assert.Equal(t, "node-1", node.ID, tc.name)
+			}
+			assert.Equal(t, tc.expectedDeleted, deleted, tc.name)
+		})
+	}
+}
+
+func Test_JoinGracePeriod(t *testing.T) {
+	testCases := []struct {
+		name          string
+		config        map[string]string
+		expectedGrace time.Duration
+		expectedErr   bool
+	}{
+		{name: "default", config: map[string]string{}, expectedGrace: defaultJoinGracePeriod},
+		{name: "longer than the join timeout", config: map[string]string{"join_grace_period": "15m", "join_timeout": "10m"}, expectedGrace: 15 * time.Minute},
+		{name: "not longer than the join timeout", config: map[string]string{"join_grace_period": "10m", "join_timeout": "10m"}, expectedErr: true},
+		{name: "default not longer than the join timeout", config: map[string]string{"join_timeout": "15m"}, expectedErr: true},
+		{
+			name:        "not longer than the join and job timeouts",
+			config:      map[string]string{"join_grace_period": "15m", "join_timeout": "10m", "post_join_job": "warm"},
+			expectedErr: true,
+		},
+		{
+			name:          "longer than the join and job timeouts",
+			config:        map[string]string{"join_grace_period": "15m", "join_timeout": "5m", "post_join_job": "warm", "job_timeout": "5m"},
+			expectedGrace: 15 * time.Minute,
+		},
+		{name: "invalid", config: map[string]string{"join_grace_period": "soon"}, expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			grace, err := joinGracePeriod(tc.config)
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedGrace, grace, tc.name)
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/gophercloud/v2/openstack/loadbalancer/v2/listeners"
+	"github.com/gophercloud/gophercloud/v2/openstack/loadbalancer/v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/v2/openstack/loadbalancer/v2/pools"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/plugins"
+	"github.com/hashicorp/nomad-autoscaler/plugins/base"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+const (
+	// octaviaPluginName is the unique name of the this plugin amongst APM plugins.
+	octaviaPluginName = "os-octavia"
+
+	configKeyQueryTimeout = "query_timeout"
+
+	defaultQueryTimeout = 30 * time.Second
+
+	// rateSuffix can be appended to the counter metrics to get its per second
+	// rate between two consecutive queries.
+	rateSuffix = "_rate"
+)
+
+var (
+	OctaviaPluginConfig = &plugins.InternalPluginConfig{
+		Factory: func(l hclog.Logger) interface{} { return NewOctaviaAPMPlugin(l) },
+	}
+
+	octaviaPluginInfo = &base.PluginInfo{
+		Name:       octaviaPluginName,
+		PluginType: sdk.PluginTypeAPM,
+	}
+)
+
+// OctaviaAPMPlugin is the OS Octavia implementation of the apm.APM interface.
+// It exposes load balancer, listener, pool and member statistics.
+type OctaviaAPMPlugin struct {
+	config           map[string]string
+	logger           hclog.Logger
+	lbClient         *gophercloud.ServiceClient
+	stopSecretsWatch func()
+	queryTimeout     time.Duration
+
+	// samples keeps the last value of every counter queried, used to
+	// calculate rates.
+	samples     map[string]sdk.TimestampedMetric
+	samplesLock sync.Mutex
+}
+
+// NewOctaviaAPMPlugin returns the OS Octavia implementation of the apm.APM
+// interface.
+func NewOctaviaAPMPlugin(log hclog.Logger) *OctaviaAPMPlugin {
+	return &OctaviaAPMPlugin{
+		logger:  log,
+		samples: make(map[string]sdk.TimestampedMetric),
+	}
+}
+
+// SetConfig satisfies the SetConfig function on the base.Base interface.
+func (a *OctaviaAPMPlugin) SetConfig(config map[string]string) error {
+	a.config = config
+
+	a.queryTimeout = defaultQueryTimeout
+	if timeout, ok := config[configKeyQueryTimeout]; ok {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse query_timeout: %v", err)
+		}
+		a.queryTimeout = d
+	}
+
+	provider, err := newProviderClient(context.Background(), config, a.logger)
+	if err != nil {
+		return err
+	}
+	if a.stopSecretsWatch != nil {
+		a.stopSecretsWatch()
+	}
+	if a.stopSecretsWatch, err = provider.watchSecretFiles(a.logger); err != nil {
+		return err
+	}
+	lbClient, err := newServiceClient(provider.ProviderClient, provider.endpoint, config, "loadbalancer", openstack.NewLoadBalancerV2)
+	if err != nil {
+		return fmt.Errorf("failed to create OS load balancer client: %v", err)
+	}
+	a.lbClient = lbClient
+
+	a.logger.Info("completed set-up of plugin", "version", version)
+	return nil
+}
+
+// PluginInfo satisfies the PluginInfo function on the base.Base interface.
+func (a *OctaviaAPMPlugin) PluginInfo() (*base.PluginInfo, error) {
+	return octaviaPluginInfo, nil
+}
+
+// Query satisfies the Query function on the apm.APM interface.
+func (a *OctaviaAPMPlugin) Query(query string, _ sdk.TimeRange) (sdk.TimestampedMetrics, error) {
+	q, err := parseOctaviaQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.queryTimeout)
+	defer cancel()
+
+	value, err := a.queryValue(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %v", query, err)
+	}
+	metric := sdk.TimestampedMetric{Timestamp: time.Now(), Value: value}
+
+	if !q.rate {
+		return sdk.TimestampedMetrics{metric}, nil
+	}
+
+	// rates need two samples, the first query of a counter returns no metrics
+	a.samplesLock.Lock()
+	defer a.samplesLock.Unlock()
+	prev, ok := a.samples[q.key()]
+	a.samples[q.key()] = metric
+	if !ok {
+		return sdk.TimestampedMetrics{}, nil
+	}
+	elapsed := metric.Timestamp.Sub(prev.Timestamp).Seconds()
+	if elapsed <= 0 || metric.Value < prev.Value {
+		// counters reset when the amphorae are replaced
+		return sdk.TimestampedMetrics{}, nil
+	}
+	rate := sdk.TimestampedMetric{Timestamp: metric.Timestamp, Value: (metric.Value - prev.Value) / elapsed}
+	return sdk.TimestampedMetrics{rate}, nil
+}
+
+// QueryMultiple satisfies the QueryMultiple function on the apm.APM interface.
+func (a *OctaviaAPMPlugin) QueryMultiple(query string, r sdk.TimeRange) ([]sdk.TimestampedMetrics, error) {
+	m, err := a.Query(query, r)
+	if err != nil {
+		return nil, err
+	}
+	return []sdk.TimestampedMetrics{m}, nil
+}
+
+func (a *OctaviaAPMPlugin) queryValue(ctx context.Context, q *octaviaQuery) (float64, error) {
+	switch q.resource {
+	case "loadbalancer":
+		stats, err := loadbalancers.GetStats(ctx, a.lbClient, q.id).Extract()
+		if err != nil {
+			return 0, err
+		}
+		return statValue((*listeners.Stats)(stats), q.metric)
+	case "listener":
+		stats, err := listeners.GetStats(ctx, a.lbClient, q.id).Extract()
+		if err != nil {
+			return 0, err
+		}
+		return statValue(stats, q.metric)
+	case "pool":
+		return a.poolValue(ctx, q)
+	case "member":
+		return a.memberValue(ctx, q)
+	}
+	return 0, fmt.Errorf("unknown resource %q", q.resource)
+}
+
+// poolValue returns the member counts of a pool or, as Octavia doesn't provide
+// pool statistics, the sum of the statistics of the listeners using it.
+func (a *OctaviaAPMPlugin) poolValue(ctx context.Context, q *octaviaQuery) (float64, error) {
+	switch q.metric {
+	case "members", "members_online":
+		allPages, err := pools.ListMembers(a.lbClient, q.id, pools.ListMembersOpts{}).AllPages(ctx)
+		if err != nil {
+			return 0, err
+		}
+		members, err := pools.ExtractMembers(allPages)
+		if err != nil {
+			return 0, err
+		}
+		var count float64
+		for _, m := range members {
+			if q.metric == "members" || m.OperatingStatus == "ONLINE" {
+				count++
+			}
+		}
+		return count, nil
+	}
+
+	pool, err := pools.Get(ctx, a.lbClient, q.id).Extract()
+	if err != nil {
+		return 0, err
+	}
+	if len(pool.Listeners) == 0 {
+		return 0, fmt.Errorf("pool %s is not used by any listener", q.id)
+	}
+	var total float64
+	for _, l := range pool.Listeners {
+		stats, err := listeners.GetStats(ctx, a.lbClient, l.ID).Extract()
+		if err != nil {
+			return 0, err
+		}
+		v, err := statValue(stats, q.metric)
+		if err != nil {
+			return 0, err
+		}
+		total += v
+	}
+	return total, nil
+}
+
+// memberValue returns the status values of a pool member. Octavia doesn't
+// provide traffic statistics per member.
+func (a *OctaviaAPMPlugin) memberValue(ctx context.Context, q *octaviaQuery) (float64, error) {
+	poolID, memberID, ok := strings.Cut(q.id, "/")
+	if !ok {
+		return 0, fmt.Errorf("member must be identified as <pool_id>/<member_id>")
+	}
+	member, err := pools.GetMember(ctx, a.lbClient, poolID, memberID).Extract()
+	if err != nil {
+		return 0, err
+	}
+	switch q.metric {
+	case "online":
+		if member.OperatingStatus == "ONLINE" {
+			return 1, nil
+		}
+		return 0, nil
+	case "weight":
+		return float64(member.Weight), nil
+	}
+	return 0, fmt.Errorf("unknown member metric %q", q.metric)
+}
+
+func statValue(stats *listeners.Stats, metric string) (float64, error) {
+	switch metric {
+	case "active_connections":
+		return float64(stats.ActiveConnections), nil
+	case "total_connections":
+		return float64(stats.TotalConnections), nil
+	case "bytes_in":
+		return float64(stats.BytesIn), nil
+	case "bytes_out":
+		return float64(stats.BytesOut), nil
+	case "request_errors":
+		return float64(stats.RequestErrors), nil
+	}
+	return 0, fmt.Errorf("unknown metric %q", metric)
+}
+
+type octaviaQuery struct {
+	resource string
+	id       string
+	metric   string
+	rate     bool
+}
+
+func (q *octaviaQuery) key() string {
+	return fmt.Sprintf("%s:%s:%s", q.resource, q.id, q.metric)
+}
+
+// parseOctaviaQuery parses queries in the form <resource>:<id>:<metric>.
+func parseOctaviaQuery(query string) (*octaviaQuery, error) {
+	parts := strings.Split(strings.TrimSpace(query), ":")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid query %q, expected <resource>:<id>:<metric>", query)
+	}
+	q := &octaviaQuery{resource: parts[0], id: parts[1], metric: parts[2]}
+
+	switch q.resource {
+	case "loadbalancer", "listener", "pool", "member":
+	default:
+		return nil, fmt.Errorf("invalid query %q, unknown resource %q", query, q.resource)
+	}
+
+	if strings.HasSuffix(q.metric, rateSuffix) {
+		q.metric = strings.TrimSuffix(q.metric, rateSuffix)
+		switch q.metric {
+		case "total_connections", "bytes_in", "bytes_out", "request_errors":
+			q.rate = true
+		default:
+			return nil, fmt.Errorf("invalid query %q, rate is only available for counters", query)
+		}
+	}
+	return q, nil
+}
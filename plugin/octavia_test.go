@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseOctaviaQuery(t *testing.T) {
+	testCases := []struct {
+		name        string
+		query       string
+		expected    *octaviaQuery
+		expectedErr bool
+	}{
+		{
+			name:     "listener gauge",
+			query:    "listener:abc:active_connections",
+			expected: &octaviaQuery{resource: "listener", id: "abc", metric: "active_connections"},
+		},
+		{
+			name:     "pool rate",
+			query:    "pool:abc:bytes_out_rate",
+			expected: &octaviaQuery{resource: "pool", id: "abc", metric: "bytes_out", rate: true},
+		},
+		{
+			name:     "member",
+			query:    "member:pool/member:online",
+			expected: &octaviaQuery{resource: "member", id: "pool/member", metric: "online"},
+		},
+		{
+			name:        "rate on gauge",
+			query:       "listener:abc:active_connections_rate",
+			expectedErr: true,
+		},
+		{
+			name:        "unknown resource",
+			query:       "amphora:abc:bytes_in",
+			expectedErr: true,
+		},
+		{
+			name:        "missing metric",
+			query:       "listener:abc",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := parseOctaviaQuery(tc.query)
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expected, q, tc.name)
+		})
+	}
+}
+
+func Test_OctaviaQuery(t *testing.T) {
+	testCases := []struct {
+		name           string
+		query          string
+		previous       float64 // the sample of the previous query, 10s ago, if set
+		current        float64
+		expected       []float64
+		expectedSample float64
+	}{
+		{
+			name:     "gauge",
+			query:    "listener:l1:active_connections",
+			current:  42,
+			expected: []float64{42},
+		},
+		{
+			name:           "first rate sample",
+			query:          "listener:l1:bytes_in_rate",
+			current:        1000,
+			expected:       []float64{},
+			expectedSample: 1000,
+		},
+		{
+			name:           "rate",
+			query:          "listener:l1:bytes_in_rate",
+			previous:       1000,
+			current:        1500,
+			expected:       []float64{50},
+			expectedSample: 1500,
+		},
+		{
+			name:           "unchanged counter",
+			query:          "listener:l1:bytes_in_rate",
+			previous:       1000,
+			current:        1000,
+			expected:       []float64{0},
+			expectedSample: 1000,
+		},
+		{
+			name:           "counter reset",
+			query:          "listener:l1:bytes_in_rate",
+			previous:       1000,
+			current:        200,
+			expected:       []float64{},
+			expectedSample: 200,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newTestServiceClient(t, map[string]any{
+				"GET /lbaas/listeners/l1/stats": map[string]any{"stats": map[string]any{
+					"active_connections": tc.current,
+					"bytes_in":           tc.current,
+				}},
+			})
+			a := NewOctaviaAPMPlugin(hclog.NewNullLogger())
+			a.lbClient = client
+			a.queryTimeout = time.Minute
+
+			q, err := parseOctaviaQuery(tc.query)
+			assert.NoError(t, err, tc.name)
+			if tc.previous != 0 {
+				a.samples[q.key()] = sdk.TimestampedMetric{Timestamp: time.Now().Add(-10 * time.Second), Value: tc.previous}
+			}
+
+			metrics, err := a.Query(tc.query, sdk.TimeRange{})
+			assert.NoError(t, err, tc.name)
+			values := make([]float64, 0, len(metrics))
+			for _, m := range metrics {
+				values = append(values, m.Value)
+			}
+			assert.InDeltaSlice(t, tc.expected, values, 0.1, tc.name)
+			if q.rate {
+				assert.Equal(t, tc.expectedSample, a.samples[q.key()].Value, tc.name)
+			}
+		})
+	}
+}
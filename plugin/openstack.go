@@ -2,8 +2,7 @@ package plugin
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -26,8 +25,11 @@ import (
 	flavorutils "github.com/gophercloud/utils/v2/openstack/compute/v2/flavors"
 	imageutils "github.com/gophercloud/utils/v2/openstack/image/v2/images"
 	networkutils "github.com/gophercloud/utils/v2/openstack/networking/v2/networks"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
 	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
 	"github.com/hashicorp/nomad/api"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -40,6 +42,8 @@ const (
 	defaultScaleTimeout         = 2 * time.Hour
 	defaultNameProperty         = "unique.platform.aws.hostname"
 	poolTag                     = "na_pool:%s"
+	fipCreatedDescription       = "na_server:%s"
+	fipReusedDescription        = "na_reused:%s"
 	defaultConfigValueSeparator = ","
 	configKVSeparator           = "="
 	maxConcurrentActions        = "5"
@@ -48,76 +52,87 @@ const (
 // setupOSClients takes the passed config mapping and instantiates the
 // required OS service clients.
 func (t *TargetPlugin) setupOSClients(ctx context.Context, config map[string]string) error {
-	if t.cache == nil {
-		t.cache = make(map[string]string)
-	}
-	if t.fipIDs == nil {
-		t.fipIDs = make(map[string]string)
-	}
-	if t.memberIDs == nil {
-		t.memberIDs = make(map[string]string)
+	t.osClients = &osClients{
+		cache:     make(map[string]string),
+		fipIDs:    make(map[string]string),
+		memberIDs: make(map[string]string),
 	}
 
-	// use env vars but don't fail if not all are provided
-	ao, _ := openstack.AuthOptionsFromEnv()
+	provider, err := newProviderClient(ctx, config, t.logger)
+	if err != nil {
+		return err
+	}
 
-	if authURL, ok := config[configKeyAuthUrl]; ok {
-		ao.IdentityEndpoint = authURL
+	if err := t.configureClients(provider.ProviderClient, provider.endpoint, config); err != nil {
+		return err
 	}
-	if username, ok := config[configKeyUsername]; ok {
-		ao.Username = username
+	if t.dnsClient != nil {
+		if err := t.resolveDNSZone(ctx); err != nil {
+			return err
+		}
 	}
-	if password, ok := config[configKeyPassword]; ok {
-		ao.Password = password
+
+	t.getDefaultAvZones(ctx)
+	t.getCurrentMicroVersion(ctx, t.computeClient)
+
+	t.stopSecretsWatch, err = provider.watchSecretFiles(t.logger)
+	return err
+}
+
+// newProviderClient returns an authenticated OS provider client, and the
+// options to find the service endpoints, using the passed config mapping. It's
+// shared by all the plugins served by this binary.
+func newProviderClient(ctx context.Context, config map[string]string, logger hclog.Logger) (*providerClient, error) {
+	cloud, err := loadCloud(config)
+	if err != nil {
+		return nil, err
 	}
-	if domainName, ok := config[configKeyDomainName]; ok {
-		ao.DomainName = domainName
+	secrets, err := readSecretFiles(config)
+	if err != nil {
+		return nil, err
 	}
-	if projectID, ok := config[configKeyProjectID]; ok {
-		ao.TenantID = projectID
+	ao, err := authOptions(secrets, cloud)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authentication options: %v", err)
 	}
-	if projectName, ok := config[configKeyProjectName]; ok {
-		ao.TenantName = projectName
+	eo, err := endpointOpts(config, cloud)
+	if err != nil {
+		return nil, err
 	}
-	ao.AllowReauth = true
 
 	provider, err := openstack.NewClient(ao.IdentityEndpoint)
 	if err != nil {
-		return fmt.Errorf("failed to create OS client: %v", err)
+		return nil, fmt.Errorf("failed to create OS client: %v", err)
+	}
+	if err := configureTLS(provider, config, cloud, logger); err != nil {
+		return nil, fmt.Errorf("failed configure TLS options: %v", err)
 	}
-	if err := t.configureTLS(provider, config); err != nil {
-		return fmt.Errorf("failed configure TLS options: %v", err)
+	pluginMetrics.registerEndpoint(provider.IdentityBase, "identity")
+	transport, err := newRetryTransport(&metricsTransport{next: &tracingTransport{next: provider.HTTPClient.Transport}}, config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry options: %v", err)
 	}
+	provider.HTTPClient.Transport = transport
 	if err := openstack.Authenticate(ctx, provider, ao); err != nil {
-		return fmt.Errorf("failed to authenticate with OS: %v", err)
+		return nil, fmt.Errorf("failed to authenticate with OS: %v", err)
 	}
 
-	if err := t.configureClients(provider, config); err != nil {
-		return err
+	p := &providerClient{
+		ProviderClient: provider,
+		endpoint:       eo,
+		config:         config,
+		cloud:          cloud,
+		auth:           ao,
 	}
-
-	t.getDefaultAvZones(ctx)
-	t.getCurrentMicroVersion(ctx, t.computeClient)
-
-	t.logger.Info("completed set-up of plugin", "version", version)
-	return nil
+	// use the current credentials, that can be rotated, when reauthenticating
+	provider.ReauthFunc = p.reauthenticate
+	return p, nil
 }
 
-func (t *TargetPlugin) configureTLS(provider *gophercloud.ProviderClient, config map[string]string) error {
-	var tlsConfig *tls.Config
-
-	if certFile, ok := config[configKeyCACertFile]; ok {
-		caCert, err := os.ReadFile(certFile)
-		if err != nil {
-			return err
-		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		tlsConfig = &tls.Config{RootCAs: caCertPool}
-	}
-
-	if _, ok := config[configKeyInsecure]; ok {
-		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+func configureTLS(provider *gophercloud.ProviderClient, config map[string]string, cloud *cloudOptions, logger hclog.Logger) error {
+	tlsConfig, err := newTLSConfig(config, cloud, logger)
+	if err != nil {
+		return err
 	}
 
 	transport := &http.Transport{
@@ -138,26 +153,21 @@ func (t *TargetPlugin) configureTLS(provider *gophercloud.ProviderClient, config
 	return nil
 }
 
-func (t *TargetPlugin) configureClients(provider *gophercloud.ProviderClient, config map[string]string) error {
-	regionName := "RegionOne"
-	if region, ok := config[configKeyRegionName]; ok {
-		regionName = region
-	}
-
-	computeClient, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{Region: regionName})
+func (t *TargetPlugin) configureClients(provider *gophercloud.ProviderClient, eo gophercloud.EndpointOpts, config map[string]string) error {
+	computeClient, err := newServiceClient(provider, eo, config, "compute", openstack.NewComputeV2)
 	if err != nil {
 		return fmt.Errorf("failed to create OS compute client: %v", err)
 	}
 	t.computeClient = computeClient
 	t.computeClient.Microversion = "2.52"
 
-	imageClient, err := openstack.NewImageV2(provider, gophercloud.EndpointOpts{Region: regionName})
+	imageClient, err := newServiceClient(provider, eo, config, "image", openstack.NewImageV2)
 	if err != nil {
 		return fmt.Errorf("failed to create OS image client: %v", err)
 	}
 	t.imageClient = imageClient
 
-	networkClient, err := openstack.NewNetworkV2(provider, gophercloud.EndpointOpts{Region: regionName})
+	networkClient, err := newServiceClient(provider, eo, config, "network", openstack.NewNetworkV2)
 	if err != nil {
 		return fmt.Errorf("failed to create OS network client: %v", err)
 	}
@@ -176,13 +186,41 @@ func (t *TargetPlugin) configureClients(provider *gophercloud.ProviderClient, co
 		}
 		t.lbMemberPort = intPort
 
-		lbClient, err := openstack.NewLoadBalancerV2(provider, gophercloud.EndpointOpts{Region: regionName})
+		lbClient, err := newServiceClient(provider, eo, config, "loadbalancer", openstack.NewLoadBalancerV2)
 		if err != nil {
 			return fmt.Errorf("failed to create OS load balancer client: %v", err)
 		}
 		t.lbClient = lbClient
 	}
 
+	// the orchestration service is optional, it's only used by the heat mode
+	t.orchestrationClient = nil
+	if orchestrationClient, err := newServiceClient(provider, eo, config, "orchestration", openstack.NewOrchestrationV1); err == nil {
+		t.orchestrationClient = orchestrationClient
+	} else {
+		t.logger.Debug("orchestration service not available", "error", err)
+	}
+
+	// the clustering service is optional, it's only used by the senlin mode
+	t.clusteringClient = nil
+	if clusteringClient, err := newServiceClient(provider, eo, config, "clustering", newClusteringV1); err == nil {
+		t.clusteringClient = clusteringClient
+	} else {
+		t.logger.Debug("clustering service not available", "error", err)
+	}
+
+	// the container infra service is optional, it's only used by the magnum mode
+	t.containerInfraClient = nil
+	if containerInfraClient, err := newServiceClient(provider, eo, config, "container_infra", newContainerInfraV1); err == nil {
+		t.containerInfraClient = containerInfraClient
+	} else {
+		t.logger.Debug("container infra service not available", "error", err)
+	}
+
+	if err := t.configureDNS(provider, eo, config); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -242,30 +280,43 @@ func (t *TargetPlugin) getCurrentMicroVersion(ctx context.Context, client *gophe
 }
 
 // scaleOut updates the Auto Scaling Group desired count to match what the
-// Autoscaler has deemed required.
-func (t *TargetPlugin) scaleOut(ctx context.Context, count int64, azDist map[string]int, config map[string]string) error {
+// Autoscaler has deemed required. It returns how many servers were created,
+// fewer than requested if an error happens.
+func (t *TargetPlugin) scaleOut(ctx context.Context, count int64, azDist map[string]int, config map[string]string) (int64, error) {
 	log := t.logger.With("action", "scale_out", "pool_name", config[configKeyPoolName], "desired_count", count)
 
 	log.Debug("getting creation data from configuration")
 	createData, err := t.getCreateData(ctx, config)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	if err = t.createServers(ctx, int(count), azDist, createData); err != nil {
-		return err
+	created, err := t.createServers(ctx, int(count), azDist, createData)
+	if err != nil {
+		return int64(created), err
 	}
 
 	log.Info("successfully performed and verified scaling out")
-	return nil
+	return int64(created), nil
 }
 
 // scaleIn updates the Auto Scaling Group desired count to match what the
-// Autoscaler has deemed required.
-func (t *TargetPlugin) scaleIn(ctx context.Context, count int64, remoteIDs []string, config map[string]string) error {
-	ids, err := t.clusterUtils.RunPreScaleInTasksWithRemoteCheck(ctx, config, remoteIDs, int(count))
+// Autoscaler has deemed required. It returns how many servers were deleted,
+// fewer than requested if fewer nodes could be selected.
+func (t *TargetPlugin) scaleIn(ctx context.Context, count int64, remoteIDs []string, config map[string]string) (int64, error) {
+	hooks, err := newWebhooks(config, t.logger)
 	if err != nil {
-		return fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %v", err)
+		return 0, err
+	}
+	jobs, err := newNomadJobs(t.nomadClient, config, t.logger)
+	if err != nil {
+		return 0, err
+	}
+	drainCtx, end := startPhase(ctx, config[configKeyPoolName], phaseDrain)
+	ids, err := t.preScaleIn(drainCtx, config, remoteIDs, nil, int(count), hooks, jobs)
+	end(err)
+	if err != nil {
+		return 0, fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %v", err)
 	}
 
 	// Grab the instanceIDs
@@ -286,21 +337,22 @@ func (t *TargetPlugin) scaleIn(ctx context.Context, count int64, remoteIDs []str
 	log.Debug("deleting OS Nova instances")
 	stopFirst := config[configKeyStopFirst] != ""
 	forceDelete := config[configKeyForceDelete] != ""
-	if err := t.deleteServers(ctx, pool, stopFirst, forceDelete, instanceIDs); err != nil {
-		return fmt.Errorf("failed to delete instances: %v", err)
+	if err := t.deleteServers(ctx, pool, stopFirst, forceDelete, instanceIDs, hooks); err != nil {
+		return 0, fmt.Errorf("failed to delete instances: %v", err)
 	}
 	log.Info("successfully deleted OS Nova instances")
+	deleted := int64(len(instanceIDs))
 
 	// Run any post scale in tasks that are desired.
 	if err := t.clusterUtils.RunPostScaleInTasks(ctx, config, ids); err != nil {
-		return fmt.Errorf("failed to perform post-scale Nomad scale in tasks: %v", err)
+		return deleted, fmt.Errorf("failed to perform post-scale Nomad scale in tasks: %v", err)
 	}
 
 	log.Info("successfully performed and verified scaling in")
-	return nil
+	return deleted, nil
 }
 
-func (t *TargetPlugin) createServers(ctx context.Context, count int, azDist map[string]int, common *commonCreateData) error {
+func (t *TargetPlugin) createServers(ctx context.Context, count int, azDist map[string]int, common *commonCreateData) (int, error) {
 	customCDList := make([]*customCreateData, count)
 
 	for i := range customCDList {
@@ -320,54 +372,171 @@ func (t *TargetPlugin) createServers(ctx context.Context, count int, azDist map[
 		distributeAZ(azList, azDist, customCDList)
 	}
 
-	for _, custom := range customCDList {
+	for i, custom := range customCDList {
 		if err := t.createServer(ctx, common, custom); err != nil {
-			return err
+			return i, err
 		}
 	}
-	return nil
+	return count, nil
 }
 
-func (t *TargetPlugin) createServer(ctx context.Context, common *commonCreateData, custom *customCreateData) error {
+func (t *TargetPlugin) createServer(ctx context.Context, common *commonCreateData, custom *customCreateData) (err error) {
+	ctx, span := startSpan(ctx, "create_server", attribute.String("pool", common.pool), attribute.String("server.name", custom.name))
+	defer func() { endSpan(span, err) }()
+
 	createOpts, hintOpts, err := dataToCreateOpts(common, custom)
 	if err != nil {
 		return fmt.Errorf("failed to initialize server options: %w", err)
 	}
 
+	// the webhook can delay the creation for longer than the action timeout
+	allowed, err := common.hooks.ask(ctx, webhookEvent{Event: eventPreCreate, Pool: common.pool, Server: webhookServer{
+		Name:     custom.name,
+		AZ:       custom.availabilityzone,
+		ImageID:  common.imageID,
+		FlavorID: common.flavorID,
+	}})
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("creation of server %s refused by the %s webhook", custom.name, eventPreCreate)
+	}
+
+	// waiting for the node to join and the post_join_job have their own
+	// timeouts, so they aren't limited by the action timeout but by the scaling
+	// action one
+	scaleCtx := ctx
 	t.logger.Debug("creating instances")
 	ctx, cancel := context.WithTimeout(ctx, t.actionTimeout)
 	defer cancel()
-	server, err := servers.Create(ctx, t.computeClient, createOpts, hintOpts).Extract()
+	start := time.Now()
+
+	phaseCtx, end := startPhase(ctx, common.pool, phaseCreate)
+	server, err := servers.Create(phaseCtx, t.computeClient, createOpts, hintOpts).Extract()
+	end(err)
 	if err != nil {
+		if isQuotaExceeded(err) {
+			return fmt.Errorf("failed to create server: %w: %v", errCapacityExhausted, err)
+		}
 		return fmt.Errorf("failed to create server: %w", err)
 	}
 
+	span.SetAttributes(attribute.String("server.id", server.ID))
+
 	t.logger.Debug("waiting for active status", "server", server.ID)
-	if err := servers.WaitForStatus(ctx, t.computeClient, server.ID, "ACTIVE"); err != nil {
+	phaseCtx, end = startPhase(ctx, common.pool, phaseWaitActive)
+	active, err := t.waitForServerActive(phaseCtx, server.ID)
+	end(err)
+	if err != nil {
 		return fmt.Errorf("error waiting for server id %s to get to ACTIVE status: %w", server.ID, err)
 	}
 	t.logger.Debug("instance boot up completed")
 
-	if fipPool := common.floatingIPPool; fipPool != "" {
-		if err := t.createAndAttachFloatingIP(ctx, fipPool, server); err != nil {
+	if common.floatingIPPool != "" {
+		phaseCtx, end = startPhase(ctx, common.pool, phaseFloatingIP)
+		err = t.createAndAttachFloatingIP(phaseCtx, common, server)
+		end(err)
+		if err != nil {
 			return fmt.Errorf("error while adding floating-ip to server %s: %w", server.ID, err)
 		}
 		t.logger.Debug("floating-ip attached to server")
 	}
 	if t.lbPoolID != "" {
-		if err := t.attachToLoadBalancer(ctx, server); err != nil {
+		phaseCtx, end = startPhase(ctx, common.pool, phaseLoadBalancer)
+		err = t.attachToLoadBalancer(phaseCtx, server)
+		end(err)
+		if err != nil {
 			return fmt.Errorf("error while attaching server %s to load balancer: %w", server.ID, err)
 		}
 		t.logger.Debug("server attached to load balancer")
 	}
+	if t.dnsClient != nil {
+		phaseCtx, end = startPhase(ctx, common.pool, phaseDNS)
+		err = t.createDNSRecords(phaseCtx, server.ID)
+		end(err)
+		if err != nil {
+			return fmt.Errorf("error while creating dns records for server %s: %w", server.ID, err)
+		}
+		t.logger.Debug("server dns records created")
+	}
 
+	var node *api.NodeListStub
+	if common.joinTimeout > 0 {
+		t.logger.Debug("waiting for server node to join", "server", server.ID)
+		node, err = t.waitForJoin(scaleCtx, common, server.ID, custom.name, active.AvailabilityZone)
+		if err != nil {
+			return err
+		}
+	}
+	if common.jobs != nil && common.jobs.postJoin != "" {
+		if err := t.runPostJoinJob(scaleCtx, common, node, server.ID, custom.name); err != nil {
+			return err
+		}
+	}
+
+	// the post_create webhook only fails with the abort policy, that doesn't
+	// keep the server
+	err = common.hooks.notify(scaleCtx, webhookEvent{Event: eventPostCreate, Pool: common.pool, Server: webhookServer{
+		ID:       server.ID,
+		Name:     custom.name,
+		AZ:       active.AvailabilityZone,
+		ImageID:  common.imageID,
+		FlavorID: common.flavorID,
+	}})
+	if err != nil {
+		t.logger.Warn("post_create webhook failed, deleting server", "server", server.ID, "error", err)
+		t.deleteFailedServer(ctx, common.pool, server.ID)
+		return err
+	}
+	auditFromContext(ctx).created(auditServer{
+		ID:              server.ID,
+		Name:            custom.name,
+		AZ:              active.AvailabilityZone,
+		ImageID:         common.imageID,
+		FlavorID:        common.flavorID,
+		DurationSeconds: time.Since(start).Seconds(),
+	})
 	return nil
 }
 
-func (t *TargetPlugin) deleteServers(ctx context.Context, pool string, stopFirst, forceDelete bool, instanceIDs []string) error {
+// deleteFailedServer deletes a server that can't be used in the pool. It's
+// deleted even if the scaling action has timed out, so it isn't left behind.
+func (t *TargetPlugin) deleteFailedServer(ctx context.Context, pool, serverID string) {
+	deleteCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), t.actionTimeout)
+	defer cancel()
+	if err := t.deleteServer(deleteCtx, pool, false, false, serverID); err != nil {
+		t.logger.Error("failed to delete server", "server", serverID, "error", err)
+	}
+}
+
+func (t *TargetPlugin) deleteServers(ctx context.Context, pool string, stopFirst, forceDelete bool, instanceIDs []string, hooks *webhooks) error {
 	if t.idMapper {
 		for _, id := range instanceIDs {
-			if err := t.deleteServer(ctx, stopFirst, forceDelete, id); err != nil {
+			// the details are only known by reading the server
+			details := auditServer{ID: id}
+			if auditFromContext(ctx) != nil || hooks.sends(eventPostDelete) {
+				if server, err := servers.Get(ctx, t.computeClient, id).Extract(); err == nil {
+					details = newAuditServer(server)
+				} else {
+					t.logger.Debug("failed to get server details", "server", id, "error", err)
+				}
+			}
+
+			start := time.Now()
+			if err := t.deleteServer(ctx, pool, stopFirst, forceDelete, id); err != nil {
+				return err
+			}
+			details.DurationSeconds = time.Since(start).Seconds()
+			auditFromContext(ctx).deleted(details)
+			if err := hooks.notify(ctx, webhookEvent{Event: eventPostDelete, Pool: pool, Server: webhookServer{
+				ID:         details.ID,
+				Name:       details.Name,
+				AZ:         details.AZ,
+				ImageID:    details.ImageID,
+				FlavorID:   details.FlavorID,
+				FlavorName: details.FlavorName,
+			}}); err != nil {
 				return err
 			}
 		}
@@ -387,7 +556,21 @@ func (t *TargetPlugin) deleteServers(ctx context.Context, pool string, stopFirst
 		}
 		for _, server := range serverList {
 			if _, ok := instanceNameMap[server.Name]; ok {
-				if err := t.deleteServer(ctx, stopFirst, forceDelete, server.ID); err != nil {
+				start := time.Now()
+				if err := t.deleteServer(ctx, pool, stopFirst, forceDelete, server.ID); err != nil {
+					return false, err
+				}
+				details := newAuditServer(&server)
+				details.DurationSeconds = time.Since(start).Seconds()
+				auditFromContext(ctx).deleted(details)
+				if err := hooks.notify(ctx, webhookEvent{Event: eventPostDelete, Pool: pool, Server: webhookServer{
+					ID:         details.ID,
+					Name:       details.Name,
+					AZ:         details.AZ,
+					ImageID:    details.ImageID,
+					FlavorID:   details.FlavorID,
+					FlavorName: details.FlavorName,
+				}}); err != nil {
 					return false, err
 				}
 				instanceNameMap[server.Name] = true
@@ -407,24 +590,41 @@ func (t *TargetPlugin) deleteServers(ctx context.Context, pool string, stopFirst
 	return nil
 }
 
-func (t *TargetPlugin) deleteServer(ctx context.Context, stopFirst, forceDelete bool, instanceID string) error {
+func (t *TargetPlugin) deleteServer(ctx context.Context, pool string, stopFirst, forceDelete bool, instanceID string) (err error) {
 	log := t.logger.With("action", "delete", "instance_id", instanceID)
+	ctx, span := startSpan(ctx, "delete_server", attribute.String("pool", pool), attribute.String("server.id", instanceID))
+	defer func() { endSpan(span, err) }()
 
 	if t.lbPoolID != "" {
-		if err := t.detachFromLoadBalancer(ctx, instanceID); err != nil {
+		phaseCtx, end := startPhase(ctx, pool, phaseLoadBalancer)
+		err := t.detachFromLoadBalancer(phaseCtx, instanceID)
+		end(err)
+		if err != nil {
 			return fmt.Errorf("error while detaching server %s from load balancer: %w", instanceID, err)
 		}
 	}
+	if t.dnsClient != nil {
+		phaseCtx, end := startPhase(ctx, pool, phaseDNS)
+		err := t.deleteDNSRecords(phaseCtx, instanceID)
+		end(err)
+		if err != nil {
+			return fmt.Errorf("error while deleting dns records for server %s: %w", instanceID, err)
+		}
+	}
 
 	if t.stopBeforeDestroy || stopFirst {
 		log.Debug("stopping instance")
 		stopCtx, cancel := context.WithTimeout(ctx, t.actionTimeout)
 		defer cancel()
+		stopCtx, end := startPhase(stopCtx, pool, phaseStop)
 		if err := servers.Stop(stopCtx, t.computeClient, instanceID).ExtractErr(); err != nil {
+			end(err)
 			return fmt.Errorf("failed to stop server id %s: %v", instanceID, err)
 		}
 		log.Debug("waiting for shutoff status")
-		if err := servers.WaitForStatus(stopCtx, t.computeClient, instanceID, "SHUTOFF"); err != nil {
+		err := servers.WaitForStatus(stopCtx, t.computeClient, instanceID, "SHUTOFF")
+		end(err)
+		if err != nil {
 			return fmt.Errorf("error waiting for server id %s to get to SHUTOFF status: %v", instanceID, err)
 		}
 		log.Debug("instance shutoff completed")
@@ -433,17 +633,20 @@ func (t *TargetPlugin) deleteServer(ctx context.Context, stopFirst, forceDelete
 	log.Debug("deleting instance")
 	ctx, cancel := context.WithTimeout(ctx, t.actionTimeout)
 	defer cancel()
+	deleteCtx, end := startPhase(ctx, pool, phaseDelete)
 	if t.forceDelete || forceDelete {
-		if err := servers.ForceDelete(ctx, t.computeClient, instanceID).ExtractErr(); err != nil {
+		if err := servers.ForceDelete(deleteCtx, t.computeClient, instanceID).ExtractErr(); err != nil {
+			end(err)
 			return fmt.Errorf("failed to delete server id %s: %v", instanceID, err)
 		}
 	} else {
-		if err := servers.Delete(ctx, t.computeClient, instanceID).ExtractErr(); err != nil {
+		if err := servers.Delete(deleteCtx, t.computeClient, instanceID).ExtractErr(); err != nil {
+			end(err)
 			return fmt.Errorf("failed to delete server id %s: %v", instanceID, err)
 		}
 	}
 	log.Debug("waiting for instance deletion")
-	if err := gophercloud.WaitFor(ctx, func(ctx context.Context) (bool, error) {
+	err = gophercloud.WaitFor(deleteCtx, func(ctx context.Context) (bool, error) {
 		current, err := servers.Get(ctx, t.computeClient, instanceID).Extract()
 		if err != nil {
 			// If the server is not found, we can assume it was deleted successfully.
@@ -456,30 +659,103 @@ func (t *TargetPlugin) deleteServer(ctx context.Context, stopFirst, forceDelete
 			return true, nil
 		}
 		return false, nil
-	}); err != nil {
+	})
+	end(err)
+	if err != nil {
 		return fmt.Errorf("error waiting for server id %s to get to DELETED status: %v", instanceID, err)
 	}
 	log.Debug("instance deletion completed")
 
-	if fipID, ok := t.fipIDs[instanceID]; ok {
-		delete(t.fipIDs, instanceID)
-		if err := floatingips.Delete(ctx, t.networkClient, fipID).ExtractErr(); err != nil {
+	delete(t.fipIDs, instanceID)
+	return t.releaseFloatingIPs(ctx, instanceID)
+}
+
+// releaseFloatingIPs deletes the floating ips allocated for the server and
+// releases the reused ones. They're found by their description, so they aren't
+// left behind if the plugin restarted since the server was created.
+func (t *TargetPlugin) releaseFloatingIPs(ctx context.Context, instanceID string) error {
+	log := t.logger.With("action", "release_floating", "instance_id", instanceID)
+
+	created, err := t.listFloatingIPs(ctx, fmt.Sprintf(fipCreatedDescription, instanceID))
+	if err != nil {
+		return fmt.Errorf("error listing floating ips of server %s: %w", instanceID, err)
+	}
+	for _, fip := range created {
+		if err := floatingips.Delete(ctx, t.networkClient, fip.ID).ExtractErr(); err != nil && !isNotFound(err) {
 			return fmt.Errorf("error deleting floating ip for server %s: %w", instanceID, err)
 		}
-		log.Debug("instance floating-ip deleted")
+		log.Debug("instance floating-ip deleted", "floating_ip_id", fip.ID)
+	}
+
+	reused, err := t.listFloatingIPs(ctx, fmt.Sprintf(fipReusedDescription, instanceID))
+	if err != nil {
+		return fmt.Errorf("error listing floating ips of server %s: %w", instanceID, err)
+	}
+	for _, fip := range reused {
+		// neutron usually disassociates it together with the port, but make
+		// sure it's free to be picked again, unless it already was
+		revision := fip.RevisionNumber
+		updateOpts := floatingips.UpdateOpts{PortID: new(string), Description: new(string), RevisionNumber: &revision}
+		if err := floatingips.Update(ctx, t.networkClient, fip.ID, updateOpts).Err; err != nil {
+			if isNotFound(err) || gophercloud.ResponseCodeIs(err, http.StatusConflict) || gophercloud.ResponseCodeIs(err, http.StatusPreconditionFailed) {
+				continue
+			}
+			return fmt.Errorf("error releasing floating ip for server %s: %w", instanceID, err)
+		}
+		log.Debug("instance floating-ip released for reuse", "floating_ip_id", fip.ID)
 	}
 	return nil
 }
 
-func (t *TargetPlugin) createAndAttachFloatingIP(ctx context.Context, networkID string, server *servers.Server) error {
+// listFloatingIPs returns the floating ips with the description.
+func (t *TargetPlugin) listFloatingIPs(ctx context.Context, description string) ([]floatingips.FloatingIP, error) {
+	allPages, err := floatingips.List(t.networkClient, floatingips.ListOpts{Description: description}).AllPages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fips, err := floatingips.ExtractFloatingIPs(allPages)
+	if err != nil {
+		return nil, err
+	}
+	// don't rely on the filter being applied
+	var result []floatingips.FloatingIP
+	for _, fip := range fips {
+		if fip.Description == description {
+			result = append(result, fip)
+		}
+	}
+	return result, nil
+}
+
+func (t *TargetPlugin) createAndAttachFloatingIP(ctx context.Context, common *commonCreateData, server *servers.Server) error {
 	log := t.logger.With("action", "attach_floating", "instance_id", server.ID)
-	portID, err := t.getInstancePortID(ctx, server.ID)
+	portID, fixedIP, err := t.getInstancePort(ctx, server.ID, common.floatingIPPort)
 	if err != nil {
 		return fmt.Errorf("error getting instance port ID: %w", err)
 	}
 
+	if len(common.floatingIPReuse) > 0 {
+		fipID, err := t.associateReusableFloatingIP(ctx, common, server.ID, portID, fixedIP)
+		if err != nil {
+			return fmt.Errorf("error reusing floating ip for server %s: %w", server.ID, err)
+		}
+		if fipID != "" {
+			t.fipIDs[server.ID] = fipID
+			log.Debug("associated reusable floating ip", "floating_ip_id", fipID)
+			return nil
+		}
+		log.Debug("no reusable floating ip available, allocating a new one")
+	}
+
 	var fip floatingips.FloatingIP
-	if err := floatingips.Create(ctx, t.networkClient, floatingips.CreateOpts{FloatingNetworkID: networkID, PortID: portID}).ExtractInto(&fip); err != nil {
+	createOpts := floatingips.CreateOpts{
+		FloatingNetworkID: common.floatingIPPool,
+		SubnetID:          common.floatingIPSubnetID,
+		PortID:            portID,
+		FixedIP:           fixedIP,
+		Description:       fmt.Sprintf(fipCreatedDescription, server.ID),
+	}
+	if err := floatingips.Create(ctx, t.networkClient, createOpts).ExtractInto(&fip); err != nil {
 		return fmt.Errorf("error creating floating ip for server %s: %w", server.ID, err)
 	}
 	t.fipIDs[server.ID] = fip.ID
@@ -488,6 +764,50 @@ func (t *TargetPlugin) createAndAttachFloatingIP(ctx context.Context, networkID
 	return nil
 }
 
+// associateReusableFloatingIP looks for an unassociated floating ip in the
+// floating network that is part of the allowed reuse list and associates it
+// with the given port, setting its description to the server so it's released
+// with it. An empty ID is returned if none is available.
+func (t *TargetPlugin) associateReusableFloatingIP(ctx context.Context, common *commonCreateData, serverID, portID, fixedIP string) (string, error) {
+	allowed := make(map[string]struct{}, len(common.floatingIPReuse))
+	for _, v := range common.floatingIPReuse {
+		allowed[v] = struct{}{}
+	}
+
+	allPages, err := floatingips.List(t.networkClient, floatingips.ListOpts{FloatingNetworkID: common.floatingIPPool}).AllPages(ctx)
+	if err != nil {
+		return "", err
+	}
+	fips, err := floatingips.ExtractFloatingIPs(allPages)
+	if err != nil {
+		return "", err
+	}
+
+	for _, fip := range fips {
+		if fip.PortID != "" {
+			continue
+		}
+		_, okAddr := allowed[fip.FloatingIP]
+		_, okID := allowed[fip.ID]
+		if !okAddr && !okID {
+			continue
+		}
+		// use the revision number so we don't steal an ip that was just associated somewhere else
+		revision := fip.RevisionNumber
+		description := fmt.Sprintf(fipReusedDescription, serverID)
+		updateOpts := floatingips.UpdateOpts{PortID: &portID, FixedIP: fixedIP, Description: &description, RevisionNumber: &revision}
+		if err := floatingips.Update(ctx, t.networkClient, fip.ID, updateOpts).Err; err != nil {
+			if gophercloud.ResponseCodeIs(err, http.StatusConflict) || gophercloud.ResponseCodeIs(err, http.StatusPreconditionFailed) {
+				t.logger.Debug("floating ip was taken while associating, trying next one", "floating_ip_id", fip.ID)
+				continue
+			}
+			return "", err
+		}
+		return fip.ID, nil
+	}
+	return "", nil
+}
+
 func (t *TargetPlugin) attachToLoadBalancer(ctx context.Context, server *servers.Server) error {
 	log := t.logger.With("action", "attach_to_lb", "instance_id", server.ID, "pool_id", t.lbPoolID)
 
@@ -544,6 +864,49 @@ func (t *TargetPlugin) detachFromLoadBalancer(ctx context.Context, instanceID st
 	return nil
 }
 
+// waitForServerActive waits for the server to be ACTIVE, returning it. It fails
+// as soon as the server gets to ERROR status, deleting it if there was no host
+// to schedule it.
+func (t *TargetPlugin) waitForServerActive(ctx context.Context, id string) (*servers.Server, error) {
+	var server *servers.Server
+	err := gophercloud.WaitFor(ctx, func(ctx context.Context) (bool, error) {
+		current, err := servers.Get(ctx, t.computeClient, id).Extract()
+		if err != nil {
+			return false, err
+		}
+		switch current.Status {
+		case "ACTIVE":
+			server = current
+			return true, nil
+		case "ERROR":
+			if !strings.Contains(current.Fault.Message, "No valid host") {
+				return false, fmt.Errorf("server is in ERROR status: %s", current.Fault.Message)
+			}
+			// the server won't be rescheduled, remove it so it isn't counted in the pool
+			if err := servers.Delete(ctx, t.computeClient, id).ExtractErr(); err != nil && !isNotFound(err) {
+				t.logger.Warn("failed to delete server in ERROR status", "server", id, "error", err)
+			}
+			return false, fmt.Errorf("%w: %s", errCapacityExhausted, current.Fault.Message)
+		}
+		return false, nil
+	})
+	return server, err
+}
+
+// isQuotaExceeded checks if the server creation was rejected by the project
+// quota.
+func isQuotaExceeded(err error) bool {
+	var codeErr gophercloud.ErrUnexpectedResponseCode
+	if !errors.As(err, &codeErr) {
+		return false
+	}
+	switch codeErr.Actual {
+	case http.StatusForbidden, http.StatusRequestEntityTooLarge:
+		return strings.Contains(strings.ToLower(string(codeErr.Body)), "quota exceeded")
+	}
+	return false
+}
+
 func isNotFound(err error) bool {
 	if _, ok := err.(gophercloud.ErrResourceNotFound); ok {
 		return true
@@ -557,6 +920,7 @@ type customServer struct {
 	Name     string            `json:"name"`
 	AZ       string            `json:"OS-EXT-AZ:availability_zone"`
 	Status   string            `json:"status"`
+	Created  time.Time         `json:"created"`
 	Metadata map[string]string `json:"metadata"`
 	Tags     *[]string         `json:"tags"`
 }
@@ -566,6 +930,7 @@ func (t *TargetPlugin) countServers(ctx context.Context, pool string) (int64, in
 	var ready int64
 	azDist := make(map[string]int)
 	remoteIDs := make([]string, 0)
+	statusCounts := make(map[[2]string]int)
 
 	idFn := func(srv customServer) string {
 		return srv.Name
@@ -584,6 +949,7 @@ func (t *TargetPlugin) countServers(ctx context.Context, pool string) (int64, in
 		}
 
 		for _, v := range serverList {
+			statusCounts[[2]string{v.Status, v.AZ}]++
 			if _, ok := t.ignoredStates[v.Status]; ok {
 				t.logger.Debug("Ignored server due to state", "id", v.ID, "state", v.Status)
 				continue
@@ -603,9 +969,40 @@ func (t *TargetPlugin) countServers(ctx context.Context, pool string) (int64, in
 		}
 		return true, nil
 	})
+	if err == nil {
+		pluginMetrics.setPoolServers(pool, statusCounts)
+	}
 	return total, ready, azDist, remoteIDs, err
 }
 
+// poolServerIDs returns the IDs of the servers of the pool by name.
+func (t *TargetPlugin) poolServerIDs(ctx context.Context, pool string) (map[string]string, error) {
+	serverList, err := t.listPoolServers(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]string, len(serverList))
+	for _, server := range serverList {
+		ids[server.Name] = server.ID
+	}
+	return ids, nil
+}
+
+// listPoolServers returns the servers of the pool.
+func (t *TargetPlugin) listPoolServers(ctx context.Context, pool string) ([]customServer, error) {
+	var result []customServer
+	pager := servers.List(t.computeClient, servers.ListOpts{Tags: fmt.Sprintf(poolTag, pool)})
+	err := pager.EachPage(ctx, func(ctx context.Context, page pagination.Page) (bool, error) {
+		var serverList []customServer
+		if err := servers.ExtractServersInto(page, &serverList); err != nil {
+			return false, err
+		}
+		result = append(result, serverList...)
+		return true, nil
+	})
+	return result, err
+}
+
 type customCreateData struct {
 	name             string
 	availabilityzone string
@@ -622,11 +1019,19 @@ type commonCreateData struct {
 	securityGroups     []string
 	networkIDs         []string
 	floatingIPPool     string
+	floatingIPSubnetID string
+	floatingIPReuse    []string
+	floatingIPPort     portSelector
 	availabilityZones  []string
 	evenlydistributeAZ bool
 	userDataTemplate   string
 	metadata           map[string]string
 	tags               []string
+	hooks              *webhooks
+	jobs               *nomadJobs
+	nodeClass          string
+	joinTimeout        time.Duration
+	publishNodeMeta    bool
 }
 
 func (t *TargetPlugin) getCreateData(ctx context.Context, config map[string]string) (*commonCreateData, error) {
@@ -637,12 +1042,37 @@ func (t *TargetPlugin) getCreateData(ctx context.Context, config map[string]stri
 		userDataTemplate:   config[configKeyUserDataT],
 		evenlydistributeAZ: config[configKeyESAZ] != "",
 		serverGroupID:      config[configKeyServerGroupID],
+		nodeClass:          config[sdk.TargetConfigKeyClass],
 	}
 	configValueSeparator := defaultConfigValueSeparator
 	if sep, ok := config[configKeyValueSeparator]; ok && sep != "" {
 		configValueSeparator = sep
 	}
 
+	hooks, err := newWebhooks(config, t.logger)
+	if err != nil {
+		return nil, err
+	}
+	data.hooks = hooks
+
+	jobs, err := newNomadJobs(t.nomadClient, config, t.logger)
+	if err != nil {
+		return nil, err
+	}
+	data.jobs = jobs
+
+	if v, ok := config[configKeyJoinTimeout]; ok && v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", configKeyJoinTimeout, err)
+		}
+		data.joinTimeout = d
+	}
+	data.publishNodeMeta = config[configKeyPublishNodeMeta] != ""
+	if data.publishNodeMeta && data.joinTimeout == 0 {
+		return nil, fmt.Errorf("%s requires %s", configKeyPublishNodeMeta, configKeyJoinTimeout)
+	}
+
 	if data.name != "" && data.namePrefix != "" {
 		return nil, fmt.Errorf("only one of %s or %s can have value", configKeyName, configKeyNamePrefix)
 	}
@@ -671,6 +1101,28 @@ func (t *TargetPlugin) getCreateData(ctx context.Context, config map[string]stri
 			return nil, fmt.Errorf("error getting floating network ID: %w", err)
 		}
 		data.floatingIPPool = networkID
+		data.floatingIPSubnetID = strings.TrimSpace(config[configKeyFIPSubnetID])
+
+		if reuse, ok := config[configKeyFIPReuse]; ok && strings.TrimSpace(reuse) != "" {
+			for _, v := range strings.Split(strings.TrimSpace(reuse), configValueSeparator) {
+				if v = strings.TrimSpace(v); v != "" {
+					data.floatingIPReuse = append(data.floatingIPReuse, v)
+				}
+			}
+		}
+
+		data.floatingIPPort = portSelector{
+			networkID: strings.TrimSpace(config[configKeyFIPPortNetwork]),
+			subnetID:  strings.TrimSpace(config[configKeyFIPPortSubnet]),
+		}
+		if v, ok := config[configKeyFIPPortIPVer]; ok && strings.TrimSpace(v) != "" {
+			version, err := strconv.Atoi(strings.TrimSpace(v))
+			// neutron floating ips are IPv4 only
+			if err != nil || version != 4 {
+				return nil, fmt.Errorf("invalid value for '%s': must be 4, floating ips are IPv4 only", configKeyFIPPortIPVer)
+			}
+			data.floatingIPPort.ipVersion = version
+		}
 	}
 
 	if sgNames, ok := config[configKeySGNames]; ok && strings.TrimSpace(sgNames) != "" {
@@ -734,7 +1186,9 @@ func (t *TargetPlugin) getFlavorInfo(ctx context.Context, config map[string]stri
 	}
 
 	key := cachekey(flavorCacheKey, flavorName)
-	if id, ok := t.cache[key]; ok {
+	id, ok := t.cache[key]
+	pluginMetrics.observeCache("flavor", ok)
+	if ok {
 		return &flavorInfo{flavorID: id}, nil
 	}
 
@@ -760,7 +1214,9 @@ func (t *TargetPlugin) getImageID(ctx context.Context, config map[string]string)
 	}
 
 	key := cachekey(imageCacheKey, imageName)
-	if id, ok := t.cache[key]; ok {
+	id, ok := t.cache[key]
+	pluginMetrics.observeCache("image", ok)
+	if ok {
 		return id, nil
 	}
 
@@ -790,7 +1246,9 @@ func (t *TargetPlugin) getNetworkID(ctx context.Context, config map[string]strin
 
 func (t *TargetPlugin) getNetworkIDByName(ctx context.Context, networkName string) (string, error) {
 	key := cachekey(networkCacheKey, networkName)
-	if id, ok := t.cache[key]; ok {
+	id, ok := t.cache[key]
+	pluginMetrics.observeCache("network", ok)
+	if ok {
 		return id, nil
 	}
 
@@ -879,20 +1337,20 @@ func (t *TargetPlugin) getFloatingIPNetworkIDByName(ctx context.Context, poolNam
 	return externalNetworks[0].ID, nil
 }
 
-func (t *TargetPlugin) getInstancePortID(ctx context.Context, id string) (string, error) {
+func (t *TargetPlugin) getInstancePort(ctx context.Context, id string, sel portSelector) (string, string, error) {
 	interfacesPage, err := attachinterfaces.List(t.computeClient, id).AllPages(ctx)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	interfaces, err := attachinterfaces.ExtractInterfaces(interfacesPage)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	if len(interfaces) == 0 {
-		return "", fmt.Errorf("instance '%s' has no interfaces", id)
+		return "", "", fmt.Errorf("instance '%s' has no interfaces", id)
 	}
 
-	return interfaces[0].PortID, nil
+	return selectInterface(interfaces, sel)
 }
 
 // osNovaNodeIDMapBuilder is used to identify the Opensack Nova ID of a Nomad node using
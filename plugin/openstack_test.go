@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ReleaseFloatingIPs(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		calls []string
+	)
+	record := func(call string) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, call)
+	}
+	// the description filter isn't applied, so an unrelated ip is returned too
+	list := func(r *http.Request) any {
+		fips := []map[string]any{{"id": "fip-other", "description": "other"}}
+		switch r.URL.Query().Get("description") {
+		case "na_server:srv-1":
+			fips = append(fips, map[string]any{"id": "fip-created", "description": "na_server:srv-1"})
+		case "na_reused:srv-1":
+			fips = append(fips, map[string]any{"id": "fip-reused", "description": "na_reused:srv-1", "revision_number": 3})
+		}
+		return map[string]any{"floatingips": fips}
+	}
+	// Neutron answers the updates with 200, unlike the fake service client
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method + " " + r.URL.Path {
+		case "GET /floatingips":
+			_ = json.NewEncoder(w).Encode(list(r))
+		case "DELETE /floatingips/fip-created":
+			record("delete fip-created")
+			w.WriteHeader(http.StatusNoContent)
+		case "PUT /floatingips/fip-reused":
+			var body map[string]map[string]any
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, map[string]any{"port_id": nil, "description": ""}, body["floatingip"])
+			assert.Equal(t, "revision_number=3", r.Header.Get("If-Match"))
+			record("release fip-reused")
+			_ = json.NewEncoder(w).Encode(map[string]any{"floatingip": map[string]any{"id": "fip-reused"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	network := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{HTTPClient: *server.Client()},
+		Endpoint:       server.URL + "/",
+	}
+	p := &TargetPlugin{logger: hclog.NewNullLogger(), osClients: &osClients{networkClient: network}}
+
+	// the ips are found by their description, without the ones set in memory
+	assert.NoError(t, p.releaseFloatingIPs(context.Background(), "srv-1"))
+	assert.Equal(t, []string{"delete fip-created", "release fip-reused"}, calls)
+}
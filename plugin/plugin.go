@@ -3,16 +3,18 @@ package plugin
 import (
 	"context"
 	"fmt"
+	"maps"
 	"strings"
 	"time"
 
-	"github.com/gophercloud/gophercloud/v2"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad-autoscaler/plugins"
 	"github.com/hashicorp/nomad-autoscaler/plugins/base"
 	"github.com/hashicorp/nomad-autoscaler/sdk"
 	"github.com/hashicorp/nomad-autoscaler/sdk/helper/nomad"
 	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -47,6 +49,11 @@ const (
 	configKeyNetworkName    = "network_name"
 	configKeyNetworkNames   = "network_names"
 	configKeyFloatingIPPool = "floatingip_pool_name"
+	configKeyFIPSubnetID    = "floatingip_subnet_id"
+	configKeyFIPReuse       = "floatingip_reuse" // comma separated addresses or IDs
+	configKeyFIPPortNetwork = "floatingip_port_network_id"
+	configKeyFIPPortSubnet  = "floatingip_port_subnet_id"
+	configKeyFIPPortIPVer   = "floatingip_port_ip_version"
 	configKeySGNames        = "security_groups" // comma separated values
 	configKeyUserDataT      = "user_data_template"
 	configKeyMetadata       = "metadata" // comma separated k=v values
@@ -55,6 +62,24 @@ const (
 	configKeyLBMemberPort   = "lb_member_port"
 	configKeyLBSubnetID     = "lb_subnet_id"
 
+	configKeyDNSZone      = "dns_zone"
+	configKeyDNSZoneID    = "dns_zone_id"
+	configKeyDNSRecordT   = "dns_record_template"
+	configKeyDNSTTL       = "dns_ttl"
+	configKeyDNSPTR       = "dns_ptr"
+	configKeyDNSReconcile = "dns_reconcile_interval"
+
+	configKeyMode              = "mode"
+	configKeyStackName         = "stack_name"
+	configKeyStackResource     = "stack_resource_name"
+	configKeyStackCountParam   = "stack_count_parameter"
+	configKeyStackRemovalParam = "stack_removal_policies_parameter"
+	configKeySenlinCluster     = "senlin_cluster"
+
+	configKeyMagnumCluster       = "magnum_cluster"
+	configKeyMagnumNodeGroup     = "magnum_nodegroup"
+	configKeyMagnumStackResource = "magnum_stack_resource"
+
 	configKeyValueSeparator = "value_separator"
 	configKeyActionTimeout  = "action_timeout"
 	configKeyScaleTimeout   = "scale_timeout"
@@ -64,6 +89,18 @@ const (
 	configKeyForceDelete    = "force_delete"
 )
 
+const (
+	// modeServers manages the nova servers directly, it's the default mode.
+	modeServers = "servers"
+	// modeHeat scales an OS::Heat::ResourceGroup or OS::Heat::AutoScalingGroup
+	// updating the stack count parameter.
+	modeHeat = "heat"
+	// modeSenlin scales a Senlin cluster using resize and node deletion actions.
+	modeSenlin = "senlin"
+	// modeMagnum resizes a Magnum cluster node group.
+	modeMagnum = "magnum"
+)
+
 var (
 	PluginConfig = &plugins.InternalPluginConfig{
 		Factory: func(l hclog.Logger) interface{} { return NewOSNovaPlugin(l) },
@@ -77,38 +114,47 @@ var (
 
 // TargetPlugin is the AWS ASG implementation of the target.Target interface.
 type TargetPlugin struct {
-	config        map[string]string
-	logger        hclog.Logger
-	computeClient *gophercloud.ServiceClient
-	imageClient   *gophercloud.ServiceClient
-	networkClient *gophercloud.ServiceClient
-	lbClient      *gophercloud.ServiceClient
+	config map[string]string
+	logger hclog.Logger
+
+	// osClients are the clients of the cloud, project and region set in the
+	// plugin config, or the ones selected by the policy target.
+	*osClients
+	clients *clientsCache
+
+	// breakers stop the scale-outs of the pools that keep failing.
+	breakers *circuitBreakers
+	audit    *auditLog
+	// nodeIDs caches the remote IDs of the Nomad nodes.
+	nodeIDs    *nodeRemoteIDs
+	reconciles *reconcileTimes
 
 	idMapper          bool
-	avZones           []string
-	cache             map[string]string
-	fipIDs            map[string]string
-	memberIDs         map[string]string
+	nodeNameLookup    scaleutils.ClusterNodeIDLookupFunc
 	actionTimeout     time.Duration
 	scaleTimeout      time.Duration
 	statusTimeout     time.Duration
 	stopBeforeDestroy bool
 	forceDelete       bool
 	ignoredStates     map[string]struct{}
-	lbPoolID          string
-	lbMemberPort      int
-	lbSubnetID        string
 
 	// clusterUtils provides general cluster scaling utilities for querying the
 	// state of nodes pools and performing scaling tasks.
 	clusterUtils *scaleutils.ClusterScaleUtils
+	// nomadClient is used for the Nomad calls scaleutils doesn't provide, as
+	// its client isn't exported.
+	nomadClient *api.Client
 }
 
 // NewOSNovaPlugin returns the OS Nova implementation of the target.Target
 // interface.
 func NewOSNovaPlugin(log hclog.Logger) *TargetPlugin {
 	return &TargetPlugin{
-		logger: log,
+		logger:     log,
+		clients:    newClientsCache(),
+		breakers:   newCircuitBreakers(),
+		nodeIDs:    newNodeRemoteIDs(),
+		reconciles: newReconcileTimes(),
 	}
 }
 
@@ -116,6 +162,11 @@ func NewOSNovaPlugin(log hclog.Logger) *TargetPlugin {
 func (t *TargetPlugin) SetConfig(config map[string]string) error {
 	t.config = config
 
+	if t.osClients != nil && t.stopSecretsWatch != nil {
+		t.stopSecretsWatch()
+	}
+	t.clients.reset()
+
 	ctx := context.Background()
 	if err := t.setupOSClients(ctx, config); err != nil {
 		return err
@@ -124,6 +175,18 @@ func (t *TargetPlugin) SetConfig(config map[string]string) error {
 	if err := t.configurePlugin(config); err != nil {
 		return err
 	}
+	if err := pluginMetrics.configure(config, t.logger); err != nil {
+		return err
+	}
+	if err := configureTracing(config, t.logger); err != nil {
+		return err
+	}
+	t.audit.close()
+	audit, err := newAuditLog(config)
+	if err != nil {
+		return err
+	}
+	t.audit = audit
 
 	nomadConfig := nomad.ConfigFromNamespacedMap(config)
 	clusterUtils, err := scaleutils.NewClusterScaleUtils(nomadConfig, t.logger)
@@ -131,11 +194,24 @@ func (t *TargetPlugin) SetConfig(config map[string]string) error {
 		return err
 	}
 
+	nomadClient, err := api.NewClient(nomadConfig)
+	if err != nil {
+		return err
+	}
+	t.nomadClient = nomadClient
+
 	// Store and set the remote ID callback function.
 	t.clusterUtils = clusterUtils
 	t.clusterUtils.ClusterNodeIDLookupFunc = osNovaNodeIDMapBuilder(config[configKeyNodeNameAttr], config[configKeyNodeIDAttr])
 	t.idMapper = config[configKeyNodeIDAttr] != ""
+	// the nodes get the nova.server_id meta once they join, they're found
+	// by name until then
+	t.nodeNameLookup = nil
+	if config[configKeyNodeIDAttr] == "meta."+nodeMetaServerID {
+		t.nodeNameLookup = osNovaNodeIDMapBuilder(config[configKeyNodeNameAttr], "")
+	}
 
+	t.logger.Info("completed set-up of plugin", "version", version)
 	return nil
 }
 
@@ -181,6 +257,10 @@ func (t *TargetPlugin) configurePlugin(config map[string]string) error {
 		}
 	}
 
+	if err := t.breakers.configure(config); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -190,34 +270,61 @@ func (t *TargetPlugin) PluginInfo() (*base.PluginInfo, error) {
 }
 
 // Scale satisfies the Scale function on the target.Target interface.
-func (t *TargetPlugin) Scale(action sdk.ScalingAction, config map[string]string) error {
+func (t *TargetPlugin) Scale(action sdk.ScalingAction, config map[string]string) (err error) {
 	// OS can't support dry-run like Nomad, so just exit.
 	if action.Count == sdk.StrategyActionMetaValueDryRunCount {
 		return nil
 	}
 
-	// We cannot scale a pool without knowing the pool name.
-	pool, ok := config[configKeyPoolName]
-	if !ok {
-		return fmt.Errorf("required config param %s not found", configKeyPoolName)
+	mode, err := targetMode(config)
+	if err != nil {
+		return err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), t.scaleTimeout)
 	defer cancel()
-	total, _, azDist, remoteIDs, err := t.countServers(ctx, pool)
+	ctx, span := startSpan(ctx, "Scale",
+		attribute.String("mode", mode),
+		attribute.String("pool", config[configKeyPoolName]),
+		attribute.Int64("count", action.Count),
+		attribute.String("direction", action.Direction.String()),
+		attribute.String("reason", action.Reason))
+	defer func() { endSpan(span, err) }()
+
+	if t.audit != nil {
+		// t is replaced by the plugin of the policy target clients, that is
+		// nil if they can't be set up
+		audited := t
+		record := newAuditRecord(mode, auditPool(config), action)
+		ctx = withAuditRecord(ctx, record)
+		defer func() { audited.writeAudit(record, err) }()
+	}
+
+	t, err = t.withClients(ctx, config)
 	if err != nil {
-		return fmt.Errorf("failed to count Nova servers: %v", err)
+		return fmt.Errorf("failed to perform scaling action: %v", err)
 	}
 
-	diff, direction := t.calculateDirection(total, action.Count)
-	switch direction {
-	case "in":
-		err = t.scaleIn(ctx, diff, remoteIDs, config)
-	case "out":
-		err = t.scaleOut(ctx, diff, azDist, config)
+	pool := breakerPool(mode, config)
+	ctx = withBreakerPool(ctx, pool)
+
+	// the direction is the one of the current count, that can differ from the
+	// one of the action
+	var direction string
+	switch mode {
+	case modeHeat:
+		direction, err = t.scaleStack(ctx, action.Count, config)
+	case modeSenlin:
+		direction, err = t.scaleSenlin(ctx, action.Count, config)
+	case modeMagnum:
+		direction, err = t.scaleMagnum(ctx, action.Count, config)
 	default:
-		t.logger.Info("scaling not required", "pool_name", pool, "current_count", total, "strategy_count", action.Count)
-		return nil
+		direction, err = t.scaleServers(ctx, action.Count, config)
+	}
+	// only the scale-outs that ran count for the breaker, the refused ones
+	// return no direction
+	if direction == "out" {
+		t.breakers.record(pool, err)
 	}
 
 	// If we received an error while scaling, format this with an outer message
@@ -228,6 +335,45 @@ func (t *TargetPlugin) Scale(action sdk.ScalingAction, config map[string]string)
 	return err
 }
 
+// scaleServers scales the pool servers, returning the direction of the scaling
+// action it performed, if any.
+func (t *TargetPlugin) scaleServers(ctx context.Context, desired int64, config map[string]string) (string, error) {
+	// We cannot scale a pool without knowing the pool name.
+	pool, ok := config[configKeyPoolName]
+	if !ok {
+		return "", fmt.Errorf("required config param %s not found", configKeyPoolName)
+	}
+
+	regions, err := t.poolRegions(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	if len(regions) > 0 {
+		return t.scaleRegions(ctx, desired, regions, pool)
+	}
+
+	total, _, azDist, remoteIDs, err := t.countServers(ctx, pool)
+	if err != nil {
+		return "", fmt.Errorf("failed to count Nova servers: %v", err)
+	}
+	auditFromContext(ctx).addCount(total)
+
+	diff, direction := t.calculateDirection(total, desired)
+	switch direction {
+	case "in":
+		_, err := t.scaleIn(ctx, diff, remoteIDs, config)
+		return direction, err
+	case "out":
+		if err := t.allowScaleOut(ctx); err != nil {
+			return "", err
+		}
+		_, err := t.scaleOut(ctx, diff, azDist, config)
+		return direction, err
+	}
+	t.logger.Info("scaling not required", "pool_name", pool, "current_count", total, "strategy_count", desired)
+	return direction, nil
+}
+
 // Status satisfies the Status function on the target.Target interface.
 func (t *TargetPlugin) Status(config map[string]string) (*sdk.TargetStatus, error) {
 	// Perform our check of the Nomad node pool. If the pool is not ready, we
@@ -241,27 +387,100 @@ func (t *TargetPlugin) Status(config map[string]string) (*sdk.TargetStatus, erro
 		return &sdk.TargetStatus{Ready: ready}, nil
 	}
 
+	mode, err := targetMode(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.statusTimeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, "Status", attribute.String("mode", mode), attribute.String("pool", config[configKeyPoolName]))
+	defer func() { endSpan(span, err) }()
+
+	t, err = t.withClients(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var status *sdk.TargetStatus
+	switch mode {
+	case modeHeat:
+		status, err = t.statusStack(ctx, config)
+	case modeSenlin:
+		status, err = t.statusSenlin(ctx, config)
+	case modeMagnum:
+		status, err = t.statusMagnum(ctx, config)
+	default:
+		status, err = t.statusServers(ctx, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if meta := t.breakers.meta(breakerPool(mode, config)); meta != nil {
+		if status.Meta == nil {
+			status.Meta = make(map[string]string)
+		}
+		maps.Copy(status.Meta, meta)
+	}
+	return status, nil
+}
+
+func (t *TargetPlugin) statusServers(ctx context.Context, config map[string]string) (*sdk.TargetStatus, error) {
 	// We cannot get the status of a pool without knowing the pool name.
 	pool, ok := config[configKeyPoolName]
 	if !ok {
 		return nil, fmt.Errorf("required config param %s not found", configKeyPoolName)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), t.statusTimeout)
-	defer cancel()
-	total, active, _, _, err := t.countServers(ctx, pool)
+	regions, err := t.poolRegions(ctx, config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to count Nova servers: %v", err)
+		return nil, err
+	}
+	var resp *sdk.TargetStatus
+	plugins := []*TargetPlugin{t}
+	if len(regions) > 0 {
+		resp, err = t.statusRegions(ctx, regions, pool)
+		if err != nil {
+			return nil, err
+		}
+		plugins = plugins[:0]
+		for _, r := range regions {
+			plugins = append(plugins, r.plugin)
+		}
+	} else {
+		total, active, _, _, err := t.countServers(ctx, pool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count Nova servers: %v", err)
+		}
+		t.reconcileDNSRecords(ctx, pool)
+
+		resp = &sdk.TargetStatus{
+			Ready: total == active,
+			Count: total,
+			Meta:  make(map[string]string),
+		}
 	}
 
-	resp := &sdk.TargetStatus{
-		Ready: total == active,
-		Count: total,
-		Meta:  make(map[string]string),
+	if err := t.checkMembership(ctx, config, plugins, resp); err != nil {
+		return nil, err
 	}
+	t.reconcileNodes(ctx, config, plugins)
 	return resp, nil
 }
 
+// targetMode returns the mode the policy target uses to scale.
+func targetMode(config map[string]string) (string, error) {
+	switch mode := strings.TrimSpace(config[configKeyMode]); mode {
+	case "", modeServers:
+		return modeServers, nil
+	case modeHeat, modeSenlin, modeMagnum:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid value for '%s': unknown mode %q", configKeyMode, mode)
+	}
+}
+
 func (t *TargetPlugin) calculateDirection(target, desired int64) (int64, string) {
 	if desired < target {
 		return target - desired, "in"
@@ -0,0 +1,180 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+const (
+	configKeyRegions = "regions" // comma separated values, the first one is the primary
+
+	// regionKeyPrefix prefixes the policy target keys with the settings that
+	// only apply to a region, as in region_<name> = "k1=v1;k2=v2".
+	regionKeyPrefix    = "region_"
+	regionKVsSeparator = ";"
+)
+
+// errCapacityExhausted is returned when servers can't be created because of
+// the project quota or the lack of hypervisor capacity.
+var errCapacityExhausted = errors.New("capacity exhausted")
+
+// poolRegion is one of the regions of a multi-region pool.
+type poolRegion struct {
+	name   string
+	plugin *TargetPlugin
+	config map[string]string
+
+	total     int64
+	active    int64
+	azDist    map[string]int
+	remoteIDs []string
+}
+
+// poolRegions returns the regions of the pool, the primary first, with the
+// plugin and policy config to use in each of them. It returns nil if the pool
+// doesn't span several regions.
+func (t *TargetPlugin) poolRegions(ctx context.Context, config map[string]string) ([]*poolRegion, error) {
+	var regions []*poolRegion
+	for _, name := range strings.Split(config[configKeyRegions], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		regionConfig, err := regionPolicyConfig(config, name)
+		if err != nil {
+			return nil, err
+		}
+		plugin, err := t.withClients(ctx, regionConfig)
+		if err != nil {
+			return nil, fmt.Errorf("region %s: %v", name, err)
+		}
+		regions = append(regions, &poolRegion{name: name, plugin: plugin, config: regionConfig})
+	}
+	return regions, nil
+}
+
+// regionPolicyConfig returns the policy config to use in the region, with its
+// specific settings replacing the common ones.
+func regionPolicyConfig(config map[string]string, region string) (map[string]string, error) {
+	result := make(map[string]string, len(config))
+	for k, v := range config {
+		if k == configKeyRegions || (strings.HasPrefix(k, regionKeyPrefix) && k != configKeyRegionName) {
+			continue
+		}
+		result[k] = v
+	}
+
+	key := regionKeyPrefix + region
+	for _, kv := range strings.Split(config[key], regionKVsSeparator) {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, configKVSeparator)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for '%s': %q is not a key=value pair", key, kv)
+		}
+		result[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	result[configKeyRegionName] = region
+	return result, nil
+}
+
+// countRegions counts the servers of the pool in every region, returning the
+// totals.
+func countRegions(ctx context.Context, regions []*poolRegion, pool string) (int64, int64, error) {
+	var total, active int64
+	for _, r := range regions {
+		var err error
+		r.total, r.active, r.azDist, r.remoteIDs, err = r.plugin.countServers(ctx, pool)
+		if err != nil {
+			return 0, 0, fmt.Errorf("region %s: %v", r.name, err)
+		}
+		total += r.total
+		active += r.active
+	}
+	return total, active, nil
+}
+
+func (t *TargetPlugin) scaleRegions(ctx context.Context, desired int64, regions []*poolRegion, pool string) (string, error) {
+	total, _, err := countRegions(ctx, regions, pool)
+	if err != nil {
+		return "", fmt.Errorf("failed to count Nova servers: %v", err)
+	}
+	auditFromContext(ctx).addCount(total)
+
+	diff, direction := t.calculateDirection(total, desired)
+	switch direction {
+	case "in":
+		return direction, t.scaleInRegions(ctx, diff, regions)
+	case "out":
+		if err := t.allowScaleOut(ctx); err != nil {
+			return "", err
+		}
+		return direction, t.scaleOutRegions(ctx, diff, regions)
+	}
+	t.logger.Info("scaling not required", "pool_name", pool, "current_count", total, "strategy_count", desired)
+	return direction, nil
+}
+
+// scaleOutRegions fills the primary region first, moving to the next one when
+// a region runs out of quota or capacity.
+func (t *TargetPlugin) scaleOutRegions(ctx context.Context, count int64, regions []*poolRegion) error {
+	remaining := count
+	for _, r := range regions {
+		created, err := r.plugin.scaleOut(ctx, remaining, r.azDist, r.config)
+		remaining -= created
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errCapacityExhausted) {
+			return fmt.Errorf("region %s: %v", r.name, err)
+		}
+		t.logger.Warn("region capacity exhausted, trying next region", "region", r.name, "created", created, "remaining", remaining, "error", err)
+	}
+	return fmt.Errorf("%d servers couldn't be created: %w in all regions", remaining, errCapacityExhausted)
+}
+
+// scaleInRegions removes servers from the secondary regions first. When fewer
+// nodes than requested can be selected in a region, the rest are removed from
+// the previous ones.
+func (t *TargetPlugin) scaleInRegions(ctx context.Context, count int64, regions []*poolRegion) error {
+	remaining := count
+	for i := len(regions) - 1; i >= 0 && remaining > 0; i-- {
+		r := regions[i]
+		n := min(remaining, int64(len(r.remoteIDs)))
+		if n == 0 {
+			continue
+		}
+		deleted, err := r.plugin.scaleIn(ctx, n, r.remoteIDs, r.config)
+		if err != nil {
+			return fmt.Errorf("region %s: %v", r.name, err)
+		}
+		remaining -= deleted
+	}
+	if remaining > 0 {
+		t.logger.Warn("unable to remove all the requested servers", "requested", count, "remaining", remaining)
+	}
+	return nil
+}
+
+func (t *TargetPlugin) statusRegions(ctx context.Context, regions []*poolRegion, pool string) (*sdk.TargetStatus, error) {
+	total, active, err := countRegions(ctx, regions, pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count Nova servers: %v", err)
+	}
+
+	meta := make(map[string]string)
+	for _, r := range regions {
+		r.plugin.reconcileDNSRecords(ctx, pool)
+		meta["region_"+r.name] = fmt.Sprint(r.total)
+	}
+	return &sdk.TargetStatus{
+		Ready: total == active,
+		Count: total,
+		Meta:  meta,
+	}, nil
+}
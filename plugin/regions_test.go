@@ -0,0 +1,122 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RegionPolicyConfig(t *testing.T) {
+	config := map[string]string{
+		"pool_name":        "pool",
+		"image_name":       "image",
+		"flavor_name":      "flavor",
+		"regions":          "RegionOne,RegionTwo",
+		"region_RegionTwo": "image_name=image-two; network_ids=net-a,net-b",
+	}
+
+	regionConfig, err := regionPolicyConfig(config, "RegionOne")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"pool_name":   "pool",
+		"image_name":  "image",
+		"flavor_name": "flavor",
+		"region_name": "RegionOne",
+	}, regionConfig)
+
+	regionConfig, err = regionPolicyConfig(config, "RegionTwo")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"pool_name":   "pool",
+		"image_name":  "image-two",
+		"flavor_name": "flavor",
+		"network_ids": "net-a,net-b",
+		"region_name": "RegionTwo",
+	}, regionConfig)
+
+	_, err = regionPolicyConfig(map[string]string{"region_RegionTwo": "image_name"}, "RegionTwo")
+	assert.Error(t, err)
+}
+
+func Test_IsQuotaExceeded(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name:     "quota exceeded",
+			err:      gophercloud.ErrUnexpectedResponseCode{Actual: http.StatusForbidden, Body: []byte(`{"forbidden": {"message": "Quota exceeded for instances: Requested 1, but already used 10 of 10 instances"}}`)},
+			expected: true,
+		},
+		{
+			name:     "wrapped quota exceeded",
+			err:      fmt.Errorf("failed: %w", gophercloud.ErrUnexpectedResponseCode{Actual: http.StatusRequestEntityTooLarge, Body: []byte("Quota exceeded for cores")}),
+			expected: true,
+		},
+		{
+			name: "forbidden",
+			err:  gophercloud.ErrUnexpectedResponseCode{Actual: http.StatusForbidden, Body: []byte("Policy doesn't allow it")},
+		},
+		{
+			name: "other error",
+			err:  fmt.Errorf("connection refused"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isQuotaExceeded(tc.err), tc.name)
+		})
+	}
+}
+
+func Test_WaitForServerActive(t *testing.T) {
+	testCases := []struct {
+		name            string
+		status          string
+		fault           string
+		expectedDeleted bool
+		expectedErr     error
+	}{
+		{name: "active", status: "ACTIVE"},
+		{name: "no valid host", status: "ERROR", fault: "No valid host was found.", expectedDeleted: true, expectedErr: errCapacityExhausted},
+		{name: "error", status: "ERROR", fault: "Build of instance aborted", expectedErr: errors.New("server is in ERROR status: Build of instance aborted")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var deleted bool
+			client := newTestServiceClient(t, map[string]any{
+				"GET /servers/srv-1": map[string]any{"server": map[string]any{
+					"id":     "srv-1",
+					"status": tc.status,
+					"fault":  map[string]any{"message": tc.fault},
+				}},
+				"DELETE /servers/srv-1": func(*http.Request) any {
+					deleted = true
+					return nil
+				},
+			})
+
+			p := &TargetPlugin{logger: hclog.NewNullLogger(), osClients: &osClients{computeClient: client}}
+			server, err := p.waitForServerActive(context.Background(), "srv-1")
+			switch {
+			case tc.expectedErr == errCapacityExhausted:
+				assert.ErrorIs(t, err, errCapacityExhausted, tc.name)
+			case tc.expectedErr != nil:
+				assert.EqualError(t, err, tc.expectedErr.Error(), tc.name)
+			default:
+				assert.NoError(t, err, tc.name)
+				assert.Equal(t, "srv-1", server.ID, tc.name)
+			}
+			assert.Equal(t, tc.expectedDeleted, deleted, tc.name)
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package plugin
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	configKeyMaxRetries   = "max_retries"
+	configKeyRetryWaitMin = "retry_wait_min"
+	configKeyRetryWaitMax = "retry_wait_max"
+	configKeyRateLimit    = "rate_limit" // requests per second
+
+	defaultMaxRetries   = 3
+	defaultRetryWaitMin = 1 * time.Second
+	defaultRetryWaitMax = 30 * time.Second
+)
+
+// retryTransport retries the OS API requests that fail with a transient error,
+// waiting with a jittered exponential backoff, and limits the rate of requests
+// sent.
+type retryTransport struct {
+	next     http.RoundTripper
+	retries  int
+	waitMin  time.Duration
+	waitMax  time.Duration
+	interval time.Duration // zero means no rate limit
+
+	lock        sync.Mutex
+	nextRequest time.Time
+}
+
+// newRetryTransport builds the transport with the retry and rate limit
+// settings of the config.
+func newRetryTransport(next http.RoundTripper, config map[string]string) (*retryTransport, error) {
+	rt := &retryTransport{
+		next:    next,
+		retries: defaultMaxRetries,
+		waitMin: defaultRetryWaitMin,
+		waitMax: defaultRetryWaitMax,
+	}
+	if v, ok := config[configKeyMaxRetries]; ok && v != "" {
+		retries, err := strconv.Atoi(v)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("invalid value for '%s': must be a positive integer", configKeyMaxRetries)
+		}
+		rt.retries = retries
+	}
+	for key, field := range map[string]*time.Duration{
+		configKeyRetryWaitMin: &rt.waitMin,
+		configKeyRetryWaitMax: &rt.waitMax,
+	} {
+		if v, ok := config[key]; ok && v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %v", key, err)
+			}
+			*field = d
+		}
+	}
+	if rt.waitMin > rt.waitMax {
+		return nil, fmt.Errorf("%s can't be greater than %s", configKeyRetryWaitMin, configKeyRetryWaitMax)
+	}
+	if v, ok := config[configKeyRateLimit]; ok && v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid value for '%s': must be a positive number of requests per second", configKeyRateLimit)
+		}
+		rt.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return rt, nil
+}
+
+// RoundTrip sends every attempt as a copy of the request, as the caller's one
+// must not be modified, with the body read again from GetBody.
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attemptReq := req.Clone(req.Context())
+	for attempt := 0; ; attempt++ {
+		if err := rt.wait(req, rt.reserve()); err != nil {
+			return nil, err
+		}
+
+		resp, err := rt.next.RoundTrip(attemptReq)
+		if attempt >= rt.retries || !retryable(req, resp, err) {
+			return resp, err
+		}
+		delay, ok := rt.backoff(req, attempt, resp)
+		if !ok {
+			// the request would time out before the next attempt
+			return resp, err
+		}
+		attemptReq = req.Clone(req.Context())
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			attemptReq.Body = body
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if err := rt.wait(req, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// reserve returns how long to wait to send the next request without exceeding
+// the rate limit.
+func (rt *retryTransport) reserve() time.Duration {
+	if rt.interval == 0 {
+		return 0
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	now := time.Now()
+	if rt.nextRequest.Before(now) {
+		rt.nextRequest = now
+	}
+	delay := rt.nextRequest.Sub(now)
+	rt.nextRequest = rt.nextRequest.Add(rt.interval)
+	return delay
+}
+
+// backoff returns how long to wait before the next attempt: an exponential
+// backoff with full jitter up to the maximum wait, or the time asked by the
+// Retry-After header if it's longer, as retrying earlier would be refused
+// again. It returns false if the request deadline expires before.
+func (rt *retryTransport) backoff(req *http.Request, attempt int, resp *http.Response) (time.Duration, bool) {
+	delay := rt.waitMin << attempt
+	if delay <= 0 || delay > rt.waitMax {
+		delay = rt.waitMax
+	}
+	delay = rt.waitMin + rand.N(delay-rt.waitMin+1)
+
+	if resp != nil {
+		if after := retryAfter(resp.Header.Get("Retry-After")); after > delay {
+			delay = after
+		}
+	}
+	if deadline, ok := req.Context().Deadline(); ok && delay > time.Until(deadline) {
+		return delay, false
+	}
+	return delay, true
+}
+
+func (rt *retryTransport) wait(req *http.Request, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-req.Context().Done():
+		return req.Context().Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryable returns whether the request can be sent again. Requests that may
+// create resources are only retried when the API refused to handle them, so
+// they are never processed twice.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	idempotent := req.Method != http.MethodPost && req.Method != http.MethodPatch
+	if err != nil {
+		return idempotent && req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusConflict, http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// retryAfter parses the value of a Retry-After header, either in seconds or as
+// a date.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
@@ -0,0 +1,177 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Retryable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		method   string
+		status   int
+		err      error
+		expected bool
+	}{
+		{name: "get conflict", method: http.MethodGet, status: http.StatusConflict, expected: true},
+		{name: "get server error", method: http.MethodGet, status: http.StatusInternalServerError, expected: true},
+		{name: "get not found", method: http.MethodGet, status: http.StatusNotFound, expected: false},
+		{name: "get connection error", method: http.MethodGet, err: fmt.Errorf("connection reset"), expected: true},
+		{name: "post rate limited", method: http.MethodPost, status: http.StatusTooManyRequests, expected: true},
+		{name: "post unavailable", method: http.MethodPost, status: http.StatusServiceUnavailable, expected: true},
+		{name: "post server error", method: http.MethodPost, status: http.StatusInternalServerError, expected: false},
+		{name: "post connection error", method: http.MethodPost, err: fmt.Errorf("connection reset"), expected: false},
+		{name: "delete conflict", method: http.MethodDelete, status: http.StatusConflict, expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "http://nova", nil)
+			var resp *http.Response
+			if tc.err == nil {
+				resp = &http.Response{StatusCode: tc.status}
+			}
+			assert.Equal(t, tc.expected, retryable(req, resp, tc.err), tc.name)
+		})
+	}
+}
+
+func Test_RetryTransport(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	rt, err := newRetryTransport(http.DefaultTransport, map[string]string{"retry_wait_min": "1ms", "retry_wait_max": "5ms"})
+	assert.NoError(t, err)
+	client := &http.Client{Transport: rt}
+
+	resp, err := client.Post(server.URL, "application/json", strings.NewReader(`{"server": {}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, 3, calls)
+
+	// the body is sent again and the request isn't modified
+	var bodies []string
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(`{"server": {}}`))
+	assert.NoError(t, err)
+	reqBody := req.Body
+	resp, err = rt.RoundTrip(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []string{`{"server": {}}`, `{"server": {}}`, `{"server": {}}`, `{"server": {}}`}, bodies)
+	assert.Equal(t, reqBody, req.Body)
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	calls = 0
+	rt.retries = 1
+	resp, err = client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, 2, calls)
+
+	_, err = newRetryTransport(http.DefaultTransport, map[string]string{"rate_limit": "0"})
+	assert.Error(t, err)
+	_, err = newRetryTransport(http.DefaultTransport, map[string]string{"retry_wait_min": "1m", "retry_wait_max": "1s"})
+	assert.Error(t, err)
+
+	rt, err = newRetryTransport(http.DefaultTransport, map[string]string{"rate_limit": "10"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), rt.reserve())
+	assert.InDelta(t, float64(100*time.Millisecond), float64(rt.reserve()), float64(10*time.Millisecond))
+}
+
+func Test_Backoff(t *testing.T) {
+	rt, err := newRetryTransport(http.DefaultTransport, map[string]string{"retry_wait_min": "1ms", "retry_wait_max": "5ms"})
+	assert.NoError(t, err)
+	rateLimited := func(after string) *http.Response {
+		return &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{after}}}
+	}
+
+	testCases := []struct {
+		name        string
+		timeout     time.Duration
+		resp        *http.Response
+		expectedMin time.Duration
+		expectedMax time.Duration
+		expectedOK  bool
+	}{
+		{name: "backoff", expectedMin: time.Millisecond, expectedMax: 5 * time.Millisecond, expectedOK: true},
+		{name: "retry after longer than the maximum wait", resp: rateLimited("10"), expectedMin: 10 * time.Second, expectedMax: 10 * time.Second, expectedOK: true},
+		{name: "retry after within the deadline", timeout: time.Minute, resp: rateLimited("10"), expectedMin: 10 * time.Second, expectedMax: 10 * time.Second, expectedOK: true},
+		{name: "retry after past the deadline", timeout: 5 * time.Second, resp: rateLimited("10"), expectedMin: 10 * time.Second, expectedMax: 10 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://nova", nil).WithContext(ctx)
+			delay, ok := rt.backoff(req, 2, tc.resp)
+			assert.Equal(t, tc.expectedOK, ok, tc.name)
+			assert.GreaterOrEqual(t, delay, tc.expectedMin, tc.name)
+			assert.LessOrEqual(t, delay, tc.expectedMax, tc.name)
+		})
+	}
+}
+
+func Test_RetryTransportDeadline(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	rt, err := newRetryTransport(http.DefaultTransport, map[string]string{"retry_wait_min": "1ms", "retry_wait_max": "5ms"})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+
+	// the rate limited response is returned at once instead of retrying early
+	start := time.Now()
+	resp, err := rt.RoundTrip(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, 1, calls)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func Test_RetryAfter(t *testing.T) {
+	assert.Equal(t, 5*time.Second, retryAfter("5"))
+	assert.Equal(t, time.Duration(0), retryAfter(""))
+	assert.Equal(t, time.Duration(0), retryAfter("soon"))
+	assert.InDelta(t, float64(time.Minute), float64(retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))), float64(2*time.Second))
+}
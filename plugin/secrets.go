@@ -0,0 +1,163 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	configKeyPasswordFile        = "password_file"
+	configKeyAppCredSecretFile   = "application_credential_secret_file"
+	configKeyTokenFile           = "token_file"
+	configKeySecretFilesInterval = "secret_files_interval"
+
+	defaultSecretFilesInterval = 30 * time.Second
+)
+
+// secretFileKeys maps the config keys of the files to the keys of the secrets
+// they contain.
+var secretFileKeys = map[string]string{
+	configKeyPasswordFile:      configKeyPassword,
+	configKeyAppCredSecretFile: configKeyAppCredSecret,
+	configKeyTokenFile:         configKeyToken,
+}
+
+// readSecretFiles returns a copy of the config mapping with the secrets read
+// from the files set in it.
+func readSecretFiles(config map[string]string) (map[string]string, error) {
+	result := maps.Clone(config)
+	for fileKey, key := range secretFileKeys {
+		path, ok := config[fileKey]
+		if !ok || path == "" {
+			continue
+		}
+		if _, ok := config[key]; ok {
+			return nil, fmt.Errorf("only one of %s or %s can be used", key, fileKey)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", fileKey, err)
+		}
+		result[key] = strings.TrimSpace(string(content))
+	}
+	return result, nil
+}
+
+// providerClient is an authenticated OS provider client, along with the
+// options to find the service endpoints, whose credentials can be replaced
+// without interrupting the requests in progress.
+type providerClient struct {
+	*gophercloud.ProviderClient
+	endpoint gophercloud.EndpointOpts
+
+	config map[string]string
+	cloud  *cloudOptions
+
+	authLock sync.Mutex
+	auth     gophercloud.AuthOptions
+}
+
+// reauthenticate gets a new token with the current credentials. It's used as
+// the provider ReauthFunc, so it's called when the token expires or the
+// credentials change.
+func (p *providerClient) reauthenticate(ctx context.Context) error {
+	p.authLock.Lock()
+	ao := p.auth
+	p.authLock.Unlock()
+	ao.AllowReauth = false
+
+	tac, err := openstack.NewClient(p.IdentityEndpoint)
+	if err != nil {
+		return err
+	}
+	tac.HTTPClient = p.HTTPClient
+	if err := openstack.Authenticate(ctx, tac, ao); err != nil {
+		return err
+	}
+	p.CopyTokenFrom(tac)
+	return nil
+}
+
+// watchSecretFiles re-authenticates the provider client when the content of
+// the secret files changes. The returned function stops watching them.
+func (p *providerClient) watchSecretFiles(logger hclog.Logger) (func(), error) {
+	if !hasAnyKey(p.config, configKeyPasswordFile, configKeyAppCredSecretFile, configKeyTokenFile) {
+		return func() {}, nil
+	}
+
+	interval := defaultSecretFilesInterval
+	if v, ok := p.config[configKeySecretFilesInterval]; ok && v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", configKeySecretFilesInterval, err)
+		}
+		interval = d
+	}
+
+	last, err := readSecretFiles(p.config)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			secrets, err := readSecretFiles(p.config)
+			if err != nil {
+				logger.Warn("failed to read secret files", "error", err)
+				continue
+			}
+			if maps.Equal(secrets, last) {
+				continue
+			}
+			if err := p.rotate(secrets); err != nil {
+				logger.Error("failed to authenticate with the updated credentials, keeping the previous ones", "error", err)
+				continue
+			}
+			last = secrets
+			logger.Info("re-authenticated with the updated credentials")
+		}
+	}()
+	return func() { close(done) }, nil
+}
+
+// rotate replaces the credentials and gets a new token with them. The previous
+// credentials are kept if the authentication fails.
+func (p *providerClient) rotate(secrets map[string]string) error {
+	ao, err := authOptions(secrets, p.cloud)
+	if err != nil {
+		return err
+	}
+
+	p.authLock.Lock()
+	previous := p.auth
+	p.auth = ao
+	p.authLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultActionTimeout)
+	defer cancel()
+	if err := p.Reauthenticate(ctx, p.Token()); err != nil {
+		p.authLock.Lock()
+		p.auth = previous
+		p.authLock.Unlock()
+		return err
+	}
+	return nil
+}
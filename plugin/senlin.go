@@ -0,0 +1,295 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+// gophercloud doesn't support the clustering service anymore, so the few calls
+// required to manage Senlin clusters are implemented here.
+
+const (
+	clusteringServiceType = "clustering"
+	// 1.4 is required for destroy_after_deletion when deleting nodes
+	clusteringMicroversion = "1.4"
+)
+
+type senlinCluster struct {
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	Status          string   `json:"status"`
+	StatusReason    string   `json:"status_reason"`
+	DesiredCapacity int64    `json:"desired_capacity"`
+	MinSize         int64    `json:"min_size"`
+	MaxSize         int64    `json:"max_size"`
+	Nodes           []string `json:"nodes"`
+}
+
+type senlinNode struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	PhysicalID string `json:"physical_id"`
+	Status     string `json:"status"`
+}
+
+type senlinAction struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	StatusReason string `json:"status_reason"`
+}
+
+// newClusteringV1 creates a ServiceClient for the Senlin clustering service.
+func newClusteringV1(provider *gophercloud.ProviderClient, eo gophercloud.EndpointOpts) (*gophercloud.ServiceClient, error) {
+	eo.ApplyDefaults(clusteringServiceType)
+	endpoint, err := provider.EndpointLocator(eo)
+	if err != nil {
+		return nil, err
+	}
+	return &gophercloud.ServiceClient{
+		ProviderClient: provider,
+		Endpoint:       endpoint,
+		ResourceBase:   endpoint + "v1/",
+		Type:           clusteringServiceType,
+		Microversion:   clusteringMicroversion,
+	}, nil
+}
+
+func (t *TargetPlugin) getSenlinCluster(ctx context.Context, config map[string]string) (*senlinCluster, error) {
+	if t.clusteringClient == nil {
+		return nil, fmt.Errorf("clustering service is not available")
+	}
+	name, ok := config[configKeySenlinCluster]
+	if !ok || name == "" {
+		return nil, fmt.Errorf("required config param %s not found", configKeySenlinCluster)
+	}
+
+	var body struct {
+		Cluster senlinCluster `json:"cluster"`
+	}
+	if _, err := t.clusteringClient.Get(ctx, t.clusteringClient.ServiceURL("clusters", url.PathEscape(name)), &body, &gophercloud.RequestOpts{OkCodes: []int{200}}); err != nil {
+		return nil, fmt.Errorf("failed to get cluster %s: %w", name, err)
+	}
+	return &body.Cluster, nil
+}
+
+func (t *TargetPlugin) listSenlinNodes(ctx context.Context, clusterID string) ([]senlinNode, error) {
+	var nodes []senlinNode
+	marker := ""
+	for {
+		query := url.Values{"cluster_id": {clusterID}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		var body struct {
+			Nodes []senlinNode `json:"nodes"`
+		}
+		if _, err := t.clusteringClient.Get(ctx, t.clusteringClient.ServiceURL("nodes")+"?"+query.Encode(), &body, &gophercloud.RequestOpts{OkCodes: []int{200}}); err != nil {
+			return nil, fmt.Errorf("failed to list cluster nodes: %w", err)
+		}
+		if len(body.Nodes) == 0 {
+			return nodes, nil
+		}
+		nodes = append(nodes, body.Nodes...)
+		marker = body.Nodes[len(body.Nodes)-1].ID
+	}
+}
+
+// senlinServerIDs returns the IDs of the servers of the cluster nodes.
+func (t *TargetPlugin) senlinServerIDs(ctx context.Context, clusterID string) ([]string, error) {
+	nodes, err := t.listSenlinNodes(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if node.PhysicalID != "" {
+			ids = append(ids, node.PhysicalID)
+		}
+	}
+	return ids, nil
+}
+
+// runClusterAction triggers a cluster action and waits for it to finish.
+func (t *TargetPlugin) runClusterAction(ctx context.Context, clusterID string, action map[string]any) error {
+	var body struct {
+		Action string `json:"action"`
+	}
+	resp, err := t.clusteringClient.Post(ctx, t.clusteringClient.ServiceURL("clusters", clusterID, "actions"), action, &body, &gophercloud.RequestOpts{OkCodes: []int{202}})
+	if err != nil {
+		return err
+	}
+
+	actionID := body.Action
+	if actionID == "" {
+		// older versions only return the action in the location header
+		location := resp.Header.Get("Location")
+		actionID = location[strings.LastIndex(location, "/")+1:]
+	}
+	if actionID == "" {
+		return fmt.Errorf("unable to get the triggered action ID")
+	}
+
+	err = gophercloud.WaitFor(ctx, func(ctx context.Context) (bool, error) {
+		var body struct {
+			Action senlinAction `json:"action"`
+		}
+		if _, err := t.clusteringClient.Get(ctx, t.clusteringClient.ServiceURL("actions", actionID), &body, &gophercloud.RequestOpts{OkCodes: []int{200}}); err != nil {
+			return false, err
+		}
+		switch body.Action.Status {
+		case "SUCCEEDED":
+			return true, nil
+		case "FAILED", "CANCELLED":
+			return false, fmt.Errorf("action %s finished with status %s: %s", actionID, body.Action.Status, body.Action.StatusReason)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for action %s to succeed: %w", actionID, err)
+	}
+	return nil
+}
+
+func (t *TargetPlugin) scaleSenlin(ctx context.Context, desired int64, config map[string]string) (string, error) {
+	cluster, err := t.getSenlinCluster(ctx, config)
+	if err != nil {
+		return "", err
+	}
+
+	auditFromContext(ctx).addCount(cluster.DesiredCapacity)
+
+	log := t.logger.With("mode", modeSenlin, "cluster", cluster.Name)
+
+	diff, direction := t.calculateDirection(cluster.DesiredCapacity, desired)
+	switch direction {
+	case "in":
+		return direction, t.scaleInSenlin(ctx, cluster, diff, config)
+	case "out":
+		if err := t.allowScaleOut(ctx); err != nil {
+			return "", err
+		}
+		log.Debug("resizing cluster", "current_count", cluster.DesiredCapacity, "desired_count", desired)
+		action := map[string]any{"resize": map[string]any{
+			"adjustment_type": "EXACT_CAPACITY",
+			"number":          desired,
+			"strict":          true,
+		}}
+		err := t.auditScaleOut(ctx, func() ([]string, error) {
+			return t.senlinServerIDs(ctx, cluster.ID)
+		}, func() error {
+			return t.runClusterAction(ctx, cluster.ID, action)
+		})
+		if err != nil {
+			return direction, fmt.Errorf("failed to resize cluster %s: %w", cluster.Name, err)
+		}
+		log.Info("successfully performed and verified scaling out")
+		return direction, nil
+	}
+	log.Info("scaling not required", "current_count", cluster.DesiredCapacity, "strategy_count", desired)
+	return direction, nil
+}
+
+func (t *TargetPlugin) scaleInSenlin(ctx context.Context, cluster *senlinCluster, count int64, config map[string]string) error {
+	nodes, err := t.listSenlinNodes(ctx, cluster.ID)
+	if err != nil {
+		return err
+	}
+
+	byRemoteID := make(map[string]senlinNode, len(nodes))
+	remoteIDs := make([]string, 0, len(nodes))
+	serverIDs := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		if node.PhysicalID == "" {
+			continue
+		}
+		remoteID := node.PhysicalID
+		if !t.idMapper {
+			server, err := servers.Get(ctx, t.computeClient, node.PhysicalID).Extract()
+			if err != nil {
+				return fmt.Errorf("failed to get server %s: %w", node.PhysicalID, err)
+			}
+			remoteID = server.Name
+		}
+		byRemoteID[remoteID] = node
+		remoteIDs = append(remoteIDs, remoteID)
+		serverIDs[remoteID] = node.PhysicalID
+	}
+
+	hooks, err := newWebhooks(config, t.logger)
+	if err != nil {
+		return err
+	}
+	jobs, err := newNomadJobs(t.nomadClient, config, t.logger)
+	if err != nil {
+		return err
+	}
+	ids, err := t.preScaleIn(ctx, config, remoteIDs, serverIDs, int(count), hooks, jobs)
+	if err != nil {
+		return fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %v", err)
+	}
+
+	log := t.logger.With("action", "scale_in", "mode", modeSenlin, "cluster", cluster.Name, "instances", ids)
+
+	nodeIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		nodeIDs = append(nodeIDs, byRemoteID[id.RemoteResourceID].ID)
+	}
+	log.Debug("deleting cluster nodes", "nodes", nodeIDs)
+	action := map[string]any{"del_nodes": map[string]any{
+		"nodes":                  nodeIDs,
+		"destroy_after_deletion": true,
+	}}
+	if err := t.runClusterAction(ctx, cluster.ID, action); err != nil {
+		return fmt.Errorf("failed to delete nodes of cluster %s: %w", cluster.Name, err)
+	}
+	log.Info("successfully deleted cluster nodes")
+	for _, id := range ids {
+		if err := t.serviceDeleted(ctx, hooks, config[configKeyPoolName], byRemoteID[id.RemoteResourceID].PhysicalID, id); err != nil {
+			return err
+		}
+	}
+
+	if err := t.clusterUtils.RunPostScaleInTasks(ctx, config, ids); err != nil {
+		return fmt.Errorf("failed to perform post-scale Nomad scale in tasks: %v", err)
+	}
+
+	log.Info("successfully performed and verified scaling in")
+	return nil
+}
+
+func (t *TargetPlugin) statusSenlin(ctx context.Context, config map[string]string) (*sdk.TargetStatus, error) {
+	cluster, err := t.getSenlinCluster(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := t.listSenlinNodes(ctx, cluster.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var active int
+	for _, node := range nodes {
+		if node.Status == "ACTIVE" {
+			active++
+		}
+	}
+
+	// WARNING means some nodes are not healthy, but the cluster can still be
+	// scaled and the health policies take care of recovering them.
+	ready := cluster.Status == "ACTIVE" || cluster.Status == "WARNING"
+	return &sdk.TargetStatus{
+		Ready: ready,
+		Count: cluster.DesiredCapacity,
+		Meta: map[string]string{
+			"cluster_status": cluster.Status,
+			"current_size":   fmt.Sprint(len(nodes)),
+			"active_nodes":   fmt.Sprint(active),
+		},
+	}, nil
+}
@@ -0,0 +1,207 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ScaleSenlin(t *testing.T) {
+	testCases := []struct {
+		name           string
+		desired        int64
+		actionStatus   string
+		expectedAction map[string]any
+		expectedDrain  []string
+		expectedErr    bool
+	}{
+		{
+			name:         "scale out",
+			desired:      5,
+			actionStatus: "SUCCEEDED",
+			expectedAction: map[string]any{"resize": map[string]any{
+				"adjustment_type": "EXACT_CAPACITY",
+				"number":          float64(5),
+				"strict":          true,
+			}},
+		},
+		{
+			name:         "scale in",
+			desired:      2,
+			actionStatus: "SUCCEEDED",
+			expectedAction: map[string]any{"del_nodes": map[string]any{
+				"nodes":                  []any{"node-3"},
+				"destroy_after_deletion": true,
+			}},
+			expectedDrain: []string{"srv-3"},
+		},
+		{
+			name:         "action failed",
+			desired:      5,
+			actionStatus: "FAILED",
+			expectedAction: map[string]any{"resize": map[string]any{
+				"adjustment_type": "EXACT_CAPACITY",
+				"number":          float64(5),
+				"strict":          true,
+			}},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var nodes []senlinNode
+			for i := 1; i <= 3; i++ {
+				nodes = append(nodes, senlinNode{ID: fmt.Sprintf("node-%d", i), PhysicalID: fmt.Sprintf("srv-%d", i), Status: "ACTIVE"})
+			}
+
+			var action map[string]any
+			client := newTestServiceClient(t, map[string]any{
+				"GET /clusters/nomad": map[string]any{"cluster": senlinCluster{ID: "c1", Name: "nomad", Status: "ACTIVE", DesiredCapacity: 3}},
+				"GET /nodes": func(r *http.Request) any {
+					assert.Equal(t, "c1", r.URL.Query().Get("cluster_id"))
+					// a single page
+					if r.URL.Query().Get("marker") != "" {
+						return map[string]any{"nodes": []senlinNode{}}
+					}
+					return map[string]any{"nodes": nodes}
+				},
+				"POST /clusters/c1/actions": func(r *http.Request) any {
+					assert.NoError(t, json.NewDecoder(r.Body).Decode(&action))
+					return map[string]any{"action": "a1"}
+				},
+				"GET /actions/a1": map[string]any{"action": senlinAction{ID: "a1", Status: tc.actionStatus}},
+			})
+			utils, _, drained := newTestClusterUtils(t, "srv-1", "srv-2", "srv-3")
+
+			p := &TargetPlugin{
+				logger:       hclog.NewNullLogger(),
+				osClients:    &osClients{clusteringClient: client},
+				idMapper:     true,
+				clusterUtils: utils,
+			}
+			_, err := p.scaleSenlin(context.Background(), tc.desired, map[string]string{
+				configKeySenlinCluster:               "nomad",
+				sdk.TargetConfigKeyClass:             "wrkr",
+				sdk.TargetConfigNodeSelectorStrategy: sdk.TargetNodeSelectorStrategyNewestCreateIndex,
+			})
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+			} else {
+				assert.NoError(t, err, tc.name)
+			}
+			assert.Equal(t, tc.expectedAction, action, tc.name)
+			assert.Equal(t, tc.expectedDrain, drained(), tc.name)
+		})
+	}
+}
+
+func Test_StatusSenlin(t *testing.T) {
+	client := newTestServiceClient(t, map[string]any{
+		"GET /clusters/nomad": map[string]any{"cluster": senlinCluster{ID: "c1", Name: "nomad", Status: "WARNING", DesiredCapacity: 3}},
+		"GET /nodes": func(r *http.Request) any {
+			if r.URL.Query().Get("marker") != "" {
+				return map[string]any{"nodes": []senlinNode{}}
+			}
+			return map[string]any{"nodes": []senlinNode{{ID: "node-1", Status: "ACTIVE"}, {ID: "node-2", Status: "ERROR"}}}
+		},
+	})
+
+	p := &TargetPlugin{logger: hclog.NewNullLogger(), osClients: &osClients{clusteringClient: client}}
+	status, err := p.statusSenlin(context.Background(), map[string]string{configKeySenlinCluster: "nomad"})
+	assert.NoError(t, err)
+	assert.True(t, status.Ready)
+	assert.Equal(t, int64(3), status.Count)
+	assert.Equal(t, map[string]string{"cluster_status": "WARNING", "current_size": "2", "active_nodes": "1"}, status.Meta)
+}
+
+func Test_ScaleSenlinHooks(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		events []webhookEvent
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		lock.Lock()
+		events = append(events, event)
+		lock.Unlock()
+		// the newest node is refused, so it's replaced
+		if event.Event == eventPreDelete && event.Server.ID == "srv-3" {
+			w.WriteHeader(http.StatusConflict)
+		}
+	}))
+	defer hook.Close()
+
+	var action map[string]any
+	client := newTestServiceClient(t, map[string]any{
+		"GET /clusters/nomad": map[string]any{"cluster": senlinCluster{ID: "c1", Name: "nomad", Status: "ACTIVE", DesiredCapacity: 3}},
+		"GET /nodes": func(r *http.Request) any {
+			if r.URL.Query().Get("marker") != "" {
+				return map[string]any{"nodes": []senlinNode{}}
+			}
+			var nodes []senlinNode
+			for i := 1; i <= 3; i++ {
+				nodes = append(nodes, senlinNode{ID: fmt.Sprintf("node-%d", i), PhysicalID: fmt.Sprintf("srv-%d", i), Status: "ACTIVE"})
+			}
+			return map[string]any{"nodes": nodes}
+		},
+		"POST /clusters/c1/actions": func(r *http.Request) any {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&action))
+			return map[string]any{"action": "a1"}
+		},
+		"GET /actions/a1": map[string]any{"action": senlinAction{ID: "a1", Status: "SUCCEEDED"}},
+	})
+	utils, _, drained := newTestClusterUtils(t, "srv-1", "srv-2", "srv-3")
+	dead := "dead"
+	var meta map[string]string
+	nomad := newTestNomad(t, map[string]any{
+		"PUT /v1/job/flush/dispatch": func(r *http.Request) any {
+			var req api.JobDispatchRequest
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			meta = req.Meta
+			return api.JobDispatchResponse{DispatchedJobID: "flush/dispatch-1"}
+		},
+		"GET /v1/job/flush/dispatch-1":         api.Job{Status: &dead},
+		"GET /v1/job/flush/dispatch-1/summary": api.JobSummary{Summary: map[string]api.TaskGroupSummary{"flush": {Complete: 1}}},
+	})
+
+	p := &TargetPlugin{
+		logger:       hclog.NewNullLogger(),
+		osClients:    &osClients{clusteringClient: client},
+		nomadClient:  nomad,
+		idMapper:     true,
+		clusterUtils: utils,
+	}
+	_, err := p.scaleSenlin(context.Background(), 2, map[string]string{
+		configKeySenlinCluster:               "nomad",
+		configKeyPoolName:                    "workers",
+		configKeyWebhookURL:                  hook.URL,
+		configKeyPreDeleteJob:                "flush",
+		sdk.TargetConfigKeyClass:             "wrkr",
+		sdk.TargetConfigNodeSelectorStrategy: sdk.TargetNodeSelectorStrategyNewestCreateIndex,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"srv-2"}, drained())
+	assert.Equal(t, map[string]string{jobMetaNodeID: "node-srv-2", jobMetaServerID: "srv-2"}, meta)
+	assert.Equal(t, map[string]any{"del_nodes": map[string]any{
+		"nodes":                  []any{"node-2"},
+		"destroy_after_deletion": true,
+	}}, action)
+
+	var sent []string
+	for _, event := range events {
+		sent = append(sent, event.Event+" "+event.Server.ID)
+	}
+	assert.Equal(t, []string{"pre_delete srv-3", "pre_delete srv-2", "post_delete srv-2"}, sent)
+	assert.Equal(t, "node-srv-2", events[2].NodeID)
+}
@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	configKeyClientCertFile = "client_cert_file"
+	configKeyClientKeyFile  = "client_key_file"
+	configKeyCACertAppend   = "cacert_append"
+	configKeyTLSMinVersion  = "tls_min_version"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig returns the TLS settings of the OS API clients, starting from the
+// ones of the cloud. It returns nil if there aren't any.
+func newTLSConfig(config map[string]string, cloud *cloudOptions, logger hclog.Logger) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if cloud != nil && cloud.tls != nil {
+		tlsConfig = cloud.tls.Clone()
+	}
+	settings := func() *tls.Config {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		return tlsConfig
+	}
+
+	// setting the key enables it, whatever the value
+	_, insecure := config[configKeyInsecure]
+
+	if certFile, ok := config[configKeyCACertFile]; ok && certFile != "" {
+		if insecure {
+			logger.Warn("the certificates of the OS APIs aren't verified, cacert_file is ignored",
+				"cacert_file", certFile, "insecure_skip_verify", config[configKeyInsecure])
+		}
+		caCert, err := os.ReadFile(certFile)
+		if err != nil {
+			return nil, err
+		}
+
+		caCertPool := x509.NewCertPool()
+		if v, ok := config[configKeyCACertAppend]; ok {
+			appendCA, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for '%s': %v", configKeyCACertAppend, err)
+			}
+			if appendCA {
+				if caCertPool, err = x509.SystemCertPool(); err != nil {
+					return nil, fmt.Errorf("failed to load the system certificates: %v", err)
+				}
+			}
+		}
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid PEM certificates found in %s", certFile)
+		}
+		settings().RootCAs = caCertPool
+	}
+
+	if insecure {
+		settings().InsecureSkipVerify = true
+	}
+
+	certFile, keyFile := config[configKeyClientCertFile], config[configKeyClientKeyFile]
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("both %s and %s are required for client certificate authentication", configKeyClientCertFile, configKeyClientKeyFile)
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %v", err)
+		}
+		settings().Certificates = []tls.Certificate{cert}
+	}
+
+	if v, ok := config[configKeyTLSMinVersion]; ok && v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return nil, fmt.Errorf("invalid value for '%s': must be one of 1.0, 1.1, 1.2 or 1.3", configKeyTLSMinVersion)
+		}
+		settings().MinVersion = version
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,176 @@
+package plugin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCert writes a self-signed client certificate and its key to the
+// dir, returning their paths and the certificate.
+func writeTestCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "autoscaler"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile, cert
+}
+
+func Test_NewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	invalidCA := filepath.Join(dir, "invalid.pem")
+	assert.NoError(t, os.WriteFile(invalidCA, []byte("not a certificate"), 0o600))
+
+	testCases := []struct {
+		name             string
+		config           map[string]string
+		expectedNil      bool
+		expectedInsecure bool
+		expectedErr      bool
+	}{
+		{
+			name:        "no settings",
+			config:      map[string]string{},
+			expectedNil: true,
+		},
+		{
+			name:             "insecure",
+			config:           map[string]string{"insecure_skip_verify": "true"},
+			expectedInsecure: true,
+		},
+		{
+			name:             "insecure set to any value",
+			config:           map[string]string{"insecure_skip_verify": "false"},
+			expectedInsecure: true,
+		},
+		{
+			name:        "ca without valid certificates",
+			config:      map[string]string{"cacert_file": invalidCA},
+			expectedErr: true,
+		},
+		{
+			name:        "client cert without key",
+			config:      map[string]string{"client_cert_file": filepath.Join(dir, "client.pem")},
+			expectedErr: true,
+		},
+		{
+			name:   "min version",
+			config: map[string]string{"tls_min_version": "1.3"},
+		},
+		{
+			name:        "invalid min version",
+			config:      map[string]string{"tls_min_version": "1.4"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tlsConfig, err := newTLSConfig(tc.config, nil, hclog.NewNullLogger())
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedNil, tlsConfig == nil, tc.name)
+			if tlsConfig != nil {
+				assert.Equal(t, tc.expectedInsecure, tlsConfig.InsecureSkipVerify, tc.name)
+			}
+		})
+	}
+
+	tlsConfig, err := newTLSConfig(map[string]string{"tls_min_version": "1.3"}, &cloudOptions{tls: &tls.Config{ServerName: "keystone"}}, hclog.NewNullLogger())
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+	assert.Equal(t, "keystone", tlsConfig.ServerName)
+}
+
+func Test_NewTLSConfigCertificates(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, clientKey, client := writeTestCert(t, dir)
+
+	// the server requires the client certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(client)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, caPEM, 0o600))
+
+	get := func(tlsConfig *tls.Config) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// the CA replaces the system certificates unless appended
+	tlsConfig, err := newTLSConfig(map[string]string{"cacert_file": caFile}, nil, hclog.NewNullLogger())
+	assert.NoError(t, err)
+	expected := x509.NewCertPool()
+	expected.AppendCertsFromPEM(caPEM)
+	assert.True(t, expected.Equal(tlsConfig.RootCAs))
+	assert.Error(t, get(tlsConfig), "no client certificate")
+
+	tlsConfig, err = newTLSConfig(map[string]string{"cacert_file": caFile, "cacert_append": "true"}, nil, hclog.NewNullLogger())
+	assert.NoError(t, err)
+	expected, err = x509.SystemCertPool()
+	assert.NoError(t, err)
+	expected.AppendCertsFromPEM(caPEM)
+	assert.True(t, expected.Equal(tlsConfig.RootCAs))
+
+	_, err = newTLSConfig(map[string]string{"cacert_file": caFile, "cacert_append": "yes"}, nil, hclog.NewNullLogger())
+	assert.Error(t, err)
+
+	tlsConfig, err = newTLSConfig(map[string]string{"cacert_file": caFile, "client_cert_file": clientCert, "client_key_file": clientKey}, nil, hclog.NewNullLogger())
+	assert.NoError(t, err)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.NoError(t, get(tlsConfig))
+
+	// the CA isn't used, but it isn't an error
+	tlsConfig, err = newTLSConfig(map[string]string{"cacert_file": caFile, "insecure_skip_verify": "true"}, nil, hclog.NewNullLogger())
+	assert.NoError(t, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+
+	// the key doesn't match the certificate
+	_, err = newTLSConfig(map[string]string{"client_cert_file": caFile, "client_key_file": clientKey}, nil, hclog.NewNullLogger())
+	assert.Error(t, err)
+}
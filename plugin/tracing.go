@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	configKeyOTLPEndpoint    = "otlp_endpoint"
+	configKeyOTLPSampleRatio = "otlp_sample_ratio"
+
+	tracerName = "github.com/jorgemarey/nomad-nova-autoscaler"
+)
+
+// openstackRequestIDHeaders are the headers the OS services return the ID of
+// the request in.
+var openstackRequestIDHeaders = []string{"X-Openstack-Request-Id", "X-Compute-Request-Id"}
+
+var (
+	tracingLock     sync.Mutex
+	tracingProvider *sdktrace.TracerProvider
+)
+
+// configureTracing sends the traces of the scaling actions to the OTLP
+// endpoint set in the config, replacing the previous one. Tracing is disabled
+// if none is set.
+func configureTracing(config map[string]string, logger hclog.Logger) error {
+	tracingLock.Lock()
+	defer tracingLock.Unlock()
+
+	if tracingProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tracingProvider.Shutdown(ctx); err != nil {
+			logger.Warn("failed to flush the traces", "error", err)
+		}
+		tracingProvider = nil
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	}
+
+	endpoint := config[configKeyOTLPEndpoint]
+	if endpoint == "" {
+		return nil
+	}
+
+	ratio := 1.0
+	if v, ok := config[configKeyOTLPSampleRatio]; ok && v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 || r > 1 {
+			return fmt.Errorf("invalid value for '%s': must be a number between 0 and 1", configKeyOTLPSampleRatio)
+		}
+		ratio = r
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+	tracingProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "nomad-nova-autoscaler"),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(tracingProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	logger.Info("sending traces", "endpoint", endpoint, "sample_ratio", ratio)
+	return nil
+}
+
+// startSpan starts a span of the plugin as a child of the one in the context.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startPhase starts the span of a phase of the creation or deletion of a
+// server of the pool. The returned function ends it, recording the duration of
+// the phase in the metrics if it succeeded.
+func startPhase(ctx context.Context, pool, phase string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, phase, attribute.String("pool", pool))
+	return ctx, func(err error) {
+		if err == nil {
+			pluginMetrics.observePhase(pool, phase, start)
+		}
+		endSpan(span, err)
+	}
+}
+
+// tracingTransport traces the requests sent to the OS APIs, propagating the
+// trace context to them.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (tt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := otel.Tracer(tracerName).Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.Redacted()),
+			attribute.String("server.address", req.URL.Hostname()),
+			attribute.String("openstack.service", pluginMetrics.service(req.URL.String())),
+		))
+	defer span.End()
+
+	if span.SpanContext().IsValid() {
+		req = req.Clone(ctx)
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	}
+
+	resp, err := tt.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	for _, header := range openstackRequestIDHeaders {
+		if id := resp.Header.Get(header); id != "" {
+			span.SetAttributes(attribute.String("openstack.request_id", id))
+			break
+		}
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
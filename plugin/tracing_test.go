@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func Test_TracingTransport(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(previousPropagator)
+	}()
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Header().Set("X-Openstack-Request-Id", "req-1234")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	ctx, span := startSpan(context.Background(), "Scale")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/servers", nil)
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &tracingTransport{next: http.DefaultTransport}}
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	endSpan(span, nil)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	httpSpan := spans[0]
+	assert.Equal(t, "HTTP POST", httpSpan.Name())
+	assert.Equal(t, span.SpanContext().SpanID(), httpSpan.Parent().SpanID())
+	assert.Contains(t, httpSpan.Attributes(), attribute.String("openstack.request_id", "req-1234"))
+	assert.Contains(t, httpSpan.Attributes(), attribute.Int("http.response.status_code", http.StatusAccepted))
+	assert.Contains(t, traceparent, httpSpan.SpanContext().TraceID().String())
+}
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	crand "crypto/rand"
 	"fmt"
+	"net"
 	"sort"
+	"sync"
 	"text/template"
+	"time"
 
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/attachinterfaces"
 	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
 )
 
@@ -119,6 +123,47 @@ func dataToCreateOpts(common *commonCreateData, custom *customCreateData) (serve
 	return createOpts, schedOpts, nil
 }
 
+// portSelector holds the criteria used to pick the instance port (and fixed
+// address) a floating ip gets associated with. Empty values match anything.
+type portSelector struct {
+	networkID string
+	subnetID  string
+	ipVersion int
+}
+
+func selectInterface(interfaces []attachinterfaces.Interface, sel portSelector) (string, string, error) {
+	for _, iface := range interfaces {
+		if sel.networkID != "" && iface.NetID != sel.networkID {
+			continue
+		}
+		// without subnet or family restrictions let neutron pick the fixed address
+		if sel.subnetID == "" && sel.ipVersion == 0 {
+			return iface.PortID, "", nil
+		}
+		for _, fixed := range iface.FixedIPs {
+			if sel.subnetID != "" && fixed.SubnetID != sel.subnetID {
+				continue
+			}
+			if sel.ipVersion != 0 && ipVersion(fixed.IPAddress) != sel.ipVersion {
+				continue
+			}
+			return iface.PortID, fixed.IPAddress, nil
+		}
+	}
+	return "", "", fmt.Errorf("no instance port matches network '%s', subnet '%s' and ip version %d", sel.networkID, sel.subnetID, sel.ipVersion)
+}
+
+func ipVersion(address string) int {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return 0
+	}
+	if ip.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
 func generateUUID() string {
 	buf := make([]byte, 16)
 	if _, err := crand.Read(buf); err != nil {
@@ -136,3 +181,44 @@ func generateUUID() string {
 func cachekey(format, name string) string {
 	return fmt.Sprintf(format, name)
 }
+
+const (
+	// failurePolicyContinue goes on with the action when a webhook or Nomad job
+	// run around it fails, it's the default.
+	failurePolicyContinue = "continue"
+	// failurePolicyAbort fails the action.
+	failurePolicyAbort = "abort"
+)
+
+// parseFailurePolicy returns the failure policy set in the config key.
+func parseFailurePolicy(config map[string]string, key string) (string, error) {
+	switch v := config[key]; v {
+	case "":
+		return failurePolicyContinue, nil
+	case failurePolicyContinue, failurePolicyAbort:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid value for '%s': must be %s or %s", key, failurePolicyContinue, failurePolicyAbort)
+	}
+}
+
+// reconcileTimes keeps when every pool was last reconciled.
+type reconcileTimes struct {
+	lock sync.Mutex
+	last map[string]time.Time
+}
+
+func newReconcileTimes() *reconcileTimes {
+	return &reconcileTimes{last: make(map[string]time.Time)}
+}
+
+// due returns whether the pool has to be reconciled, setting it as done if so.
+func (r *reconcileTimes) due(pool string, interval time.Duration) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if time.Since(r.last[pool]) < interval {
+		return false
+	}
+	r.last[pool] = time.Now()
+	return true
+}
@@ -2,7 +2,9 @@ package plugin
 
 import (
 	"testing"
+	"time"
 
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/attachinterfaces"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -57,3 +59,102 @@ func Test_AZDistribution(t *testing.T) {
 		})
 	}
 }
+
+func Test_SelectInterface(t *testing.T) {
+	interfaces := []attachinterfaces.Interface{
+		{
+			PortID: "port-1",
+			NetID:  "net-1",
+			FixedIPs: []attachinterfaces.FixedIP{
+				{SubnetID: "subnet-1", IPAddress: "10.0.0.5"},
+			},
+		},
+		{
+			PortID: "port-2",
+			NetID:  "net-2",
+			FixedIPs: []attachinterfaces.FixedIP{
+				{SubnetID: "subnet-2", IPAddress: "10.1.0.5"},
+				{SubnetID: "subnet-3", IPAddress: "2001:db8::5"},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name            string
+		sel             portSelector
+		expectedPort    string
+		expectedFixedIP string
+		expectedErr     bool
+	}{
+		{
+			name:         "no selector uses first port",
+			sel:          portSelector{},
+			expectedPort: "port-1",
+		},
+		{
+			name:         "by network",
+			sel:          portSelector{networkID: "net-2"},
+			expectedPort: "port-2",
+		},
+		{
+			name:            "by subnet",
+			sel:             portSelector{subnetID: "subnet-2"},
+			expectedPort:    "port-2",
+			expectedFixedIP: "10.1.0.5",
+		},
+		{
+			name:            "by ip version",
+			sel:             portSelector{ipVersion: 6},
+			expectedPort:    "port-2",
+			expectedFixedIP: "2001:db8::5",
+		},
+		{
+			name:        "no match",
+			sel:         portSelector{networkID: "net-1", subnetID: "subnet-2"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			port, fixedIP, err := selectInterface(interfaces, tc.sel)
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedPort, port, tc.name)
+			assert.Equal(t, tc.expectedFixedIP, fixedIP, tc.name)
+		})
+	}
+}
+
+func Test_TargetMode(t *testing.T) {
+	mode, err := targetMode(map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, modeServers, mode)
+
+	mode, err = targetMode(map[string]string{configKeyMode: "heat"})
+	assert.NoError(t, err)
+	assert.Equal(t, modeHeat, mode)
+
+	mode, err = targetMode(map[string]string{configKeyMode: "senlin"})
+	assert.NoError(t, err)
+	assert.Equal(t, modeSenlin, mode)
+
+	mode, err = targetMode(map[string]string{configKeyMode: "magnum"})
+	assert.NoError(t, err)
+	assert.Equal(t, modeMagnum, mode)
+
+	_, err = targetMode(map[string]string{configKeyMode: "unknown"})
+	assert.Error(t, err)
+}
+
+func Test_ReconcileTimes(t *testing.T) {
+	reconciles := newReconcileTimes()
+	assert.True(t, reconciles.due("pool-a", time.Hour))
+	assert.False(t, reconciles.due("pool-a", time.Hour))
+	// every pool has its own interval
+	assert.True(t, reconciles.due("pool-b", time.Hour))
+	assert.True(t, reconciles.due("pool-a", 0))
+}
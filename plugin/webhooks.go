@@ -0,0 +1,347 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+)
+
+const (
+	configKeyWebhookURL           = "webhook_url"
+	configKeyWebhookEvents        = "webhook_events"  // comma separated values
+	configKeyWebhookHeaders       = "webhook_headers" // comma separated k=v values
+	configKeyWebhookSecret        = "webhook_secret"
+	configKeyWebhookTimeout       = "webhook_timeout"
+	configKeyWebhookMaxDelay      = "webhook_max_delay"
+	configKeyWebhookFailurePolicy = "webhook_failure_policy"
+
+	defaultWebhookTimeout    = 10 * time.Second
+	defaultWebhookMaxDelay   = 30 * time.Minute
+	defaultWebhookRetryAfter = 30 * time.Second
+
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	eventPreCreate  = "pre_create"
+	eventPostCreate = "post_create"
+	eventPreDelete  = "pre_delete"
+	eventPostDelete = "post_delete"
+)
+
+var webhookEvents = []string{eventPreCreate, eventPostCreate, eventPreDelete, eventPostDelete}
+
+// webhooks call an external system before and after the pool servers are
+// created and deleted. The pre hooks can delay or refuse the action.
+type webhooks struct {
+	url           string
+	events        map[string]struct{}
+	headers       map[string]string
+	secret        string
+	maxDelay      time.Duration
+	failurePolicy string
+	client        *http.Client
+	logger        hclog.Logger
+}
+
+// webhookEvent is the payload sent to the webhook.
+type webhookEvent struct {
+	Event  string        `json:"event"`
+	Time   time.Time     `json:"time"`
+	Pool   string        `json:"pool"`
+	Server webhookServer `json:"server"`
+	NodeID string        `json:"node_id,omitempty"`
+}
+
+type webhookServer struct {
+	ID         string `json:"id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	AZ         string `json:"availability_zone,omitempty"`
+	ImageID    string `json:"image_id,omitempty"`
+	FlavorID   string `json:"flavor_id,omitempty"`
+	FlavorName string `json:"flavor_name,omitempty"`
+}
+
+// newWebhooks returns the webhooks set in the policy target config, or nil if
+// none is set.
+func newWebhooks(config map[string]string, logger hclog.Logger) (*webhooks, error) {
+	url := config[configKeyWebhookURL]
+	if url == "" {
+		return nil, nil
+	}
+
+	w := &webhooks{
+		url:           url,
+		events:        make(map[string]struct{}),
+		headers:       make(map[string]string),
+		secret:        config[configKeyWebhookSecret],
+		maxDelay:      defaultWebhookMaxDelay,
+		failurePolicy: failurePolicyContinue,
+		logger:        logger.With("webhook", url),
+	}
+
+	events := webhookEvents
+	if v := strings.TrimSpace(config[configKeyWebhookEvents]); v != "" {
+		events = strings.Split(v, defaultConfigValueSeparator)
+	}
+	for _, event := range events {
+		event = strings.TrimSpace(event)
+		if !slices.Contains(webhookEvents, event) {
+			return nil, fmt.Errorf("invalid value for '%s': unknown event %q", configKeyWebhookEvents, event)
+		}
+		w.events[event] = struct{}{}
+	}
+
+	if v := strings.TrimSpace(config[configKeyWebhookHeaders]); v != "" {
+		for _, kv := range strings.Split(v, defaultConfigValueSeparator) {
+			k, v, ok := strings.Cut(kv, configKVSeparator)
+			if !ok {
+				return nil, fmt.Errorf("invalid value for '%s': %q is not a key=value pair", configKeyWebhookHeaders, kv)
+			}
+			w.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+
+	timeout := defaultWebhookTimeout
+	for key, field := range map[string]*time.Duration{
+		configKeyWebhookTimeout:  &timeout,
+		configKeyWebhookMaxDelay: &w.maxDelay,
+	} {
+		if v, ok := config[key]; ok && v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %v", key, err)
+			}
+			*field = d
+		}
+	}
+	w.client = &http.Client{Timeout: timeout}
+
+	policy, err := parseFailurePolicy(config, configKeyWebhookFailurePolicy)
+	if err != nil {
+		return nil, err
+	}
+	w.failurePolicy = policy
+	return w, nil
+}
+
+// sends returns whether the event is sent to the webhook.
+func (w *webhooks) sends(event string) bool {
+	if w == nil {
+		return false
+	}
+	_, ok := w.events[event]
+	return ok
+}
+
+// notify sends a post event. Its response is only checked for errors.
+func (w *webhooks) notify(ctx context.Context, event webhookEvent) error {
+	_, err := w.ask(ctx, event)
+	return err
+}
+
+// ask sends the event and returns whether the action can go on. The webhook
+// allows it with a 2xx status, refuses it with 409 Conflict or delays it with
+// 202 Accepted, in which case it's sent again after the Retry-After header
+// until the maximum delay is reached, refusing it then.
+func (w *webhooks) ask(ctx context.Context, event webhookEvent) (bool, error) {
+	if !w.sends(event.Event) {
+		return true, nil
+	}
+
+	log := w.logger.With("event", event.Event, "server_id", event.Server.ID, "server_name", event.Server.Name)
+	deadline := time.Now().Add(w.maxDelay)
+	for {
+		event.Time = time.Now().UTC()
+		status, retryAfter, err := w.send(ctx, event)
+		switch {
+		case err != nil:
+			return w.failed(log, event, err)
+		case status == http.StatusConflict:
+			log.Info("action refused by webhook")
+			return false, nil
+		case status == http.StatusAccepted:
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				log.Warn("action delayed by webhook for longer than the maximum delay, refusing it", "max_delay", w.maxDelay)
+				return false, nil
+			}
+			if retryAfter <= 0 {
+				retryAfter = defaultWebhookRetryAfter
+			}
+			wait := min(retryAfter, remaining)
+			log.Info("action delayed by webhook", "retry_after", wait)
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case <-time.After(wait):
+			}
+		case status >= 200 && status < 300:
+			return true, nil
+		default:
+			return w.failed(log, event, fmt.Errorf("unexpected status code %d", status))
+		}
+	}
+}
+
+// failed applies the failure policy.
+func (w *webhooks) failed(log hclog.Logger, event webhookEvent, err error) (bool, error) {
+	if w.failurePolicy == failurePolicyAbort {
+		return false, fmt.Errorf("%s webhook failed: %v", event.Event, err)
+	}
+	log.Warn("webhook failed, going on with the action", "error", err)
+	return true, nil
+}
+
+func (w *webhooks) send(ctx context.Context, event webhookEvent) (int, time.Duration, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return 0, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	if w.secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, retryAfter(resp.Header.Get("Retry-After")), nil
+}
+
+// preScaleIn selects the nodes to remove and drains them, like
+// RunPreScaleInTasksWithRemoteCheck, asking the pre_delete webhook and running
+// the pre_delete_job before draining them. The nodes the webhook refuses are
+// replaced with other ones, if there are any. The server IDs of the remote IDs
+// are given to the jobs, they're looked up in the pool servers if not set.
+func (t *TargetPlugin) preScaleIn(ctx context.Context, config map[string]string, remoteIDs []string, serverIDs map[string]string, count int, hooks *webhooks, jobs *nomadJobs) ([]scaleutils.NodeResourceID, error) {
+	askHooks := hooks.sends(eventPreDelete)
+	runJobs := jobs != nil && jobs.preDelete != ""
+	if !askHooks && !runJobs {
+		return t.clusterUtils.RunPreScaleInTasksWithRemoteCheck(ctx, config, remoteIDs, count)
+	}
+
+	nodes, err := t.clusterUtils.IdentifyScaleInNodes(config, count)
+	if err != nil {
+		return nil, err
+	}
+	nodeIDs, err := t.clusterUtils.IdentifyScaleInRemoteIDs(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the nodes of the servers of the pool
+	nodesMap := make(map[string]*api.NodeListStub)
+	for _, n := range nodes {
+		nodesMap[n.ID] = n
+	}
+	resourceIDs := make(map[string]scaleutils.NodeResourceID)
+	var candidates []*api.NodeListStub
+	for _, id := range nodeIDs {
+		if slices.Contains(remoteIDs, id.RemoteResourceID) {
+			candidates = append(candidates, nodesMap[id.NomadNodeID])
+			resourceIDs[id.NomadNodeID] = id
+		}
+	}
+
+	var selected []scaleutils.NodeResourceID
+	for len(selected) < count && len(candidates) > 0 {
+		batch, err := t.clusterUtils.SelectScaleInNodes(candidates, config, count-len(selected))
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range batch {
+			candidates = slices.DeleteFunc(candidates, func(c *api.NodeListStub) bool { return c.ID == n.ID })
+
+			id := resourceIDs[n.ID]
+			allowed, err := hooks.ask(ctx, webhookEvent{
+				Event:  eventPreDelete,
+				Pool:   config[configKeyPoolName],
+				Server: t.webhookServer(id.RemoteResourceID),
+				NodeID: id.NomadNodeID,
+			})
+			if err != nil {
+				return nil, err
+			}
+			if allowed {
+				selected = append(selected, id)
+			}
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no nodes identified for scaling in action")
+	}
+	if len(selected) < count {
+		t.logger.Warn("can only remove portion of requested nodes", "requested", count, "available", len(selected))
+	}
+
+	if runJobs {
+		if serverIDs == nil && !t.idMapper {
+			serverIDs, err = t.poolServerIDs(ctx, config[configKeyPoolName])
+			if err != nil {
+				return nil, fmt.Errorf("failed to list pool servers: %v", err)
+			}
+		}
+		for _, id := range selected {
+			serverID := id.RemoteResourceID
+			if serverIDs != nil {
+				serverID = serverIDs[id.RemoteResourceID]
+			}
+			jobCtx, end := startPhase(ctx, config[configKeyPoolName], phaseJob)
+			err := jobs.runPreDelete(jobCtx, id.NomadNodeID, serverID)
+			end(err)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := t.clusterUtils.DrainNodes(ctx, config, selected); err != nil {
+		return nil, err
+	}
+	return selected, nil
+}
+
+// serviceDeleted records a server removed by the service of the mode and sends
+// the post_delete event. Its remote ID is its name unless the nodes are mapped
+// by server ID.
+func (t *TargetPlugin) serviceDeleted(ctx context.Context, hooks *webhooks, pool, serverID string, id scaleutils.NodeResourceID) error {
+	server := webhookServer{ID: serverID}
+	if !t.idMapper {
+		server.Name = id.RemoteResourceID
+	}
+	auditFromContext(ctx).deleted(auditServer{ID: server.ID, Name: server.Name})
+	return hooks.notify(ctx, webhookEvent{Event: eventPostDelete, Pool: pool, Server: server, NodeID: id.NomadNodeID})
+}
+
+// webhookServer returns the server of the remote ID of a Nomad node, that is
+// its ID or name depending on the attribute used to map them.
+func (t *TargetPlugin) webhookServer(remoteID string) webhookServer {
+	if t.idMapper {
+		return webhookServer{ID: remoteID}
+	}
+	return webhookServer{Name: remoteID}
+}
@@ -0,0 +1,201 @@
+package plugin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Webhooks(t *testing.T) {
+	var statuses []int
+	var received []webhookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(webhookSignatureHeader))
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+		var event webhookEvent
+		assert.NoError(t, json.Unmarshal(body, &event))
+		received = append(received, event)
+
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	config := map[string]string{
+		"webhook_url":       server.URL,
+		"webhook_secret":    "secret",
+		"webhook_headers":   "Authorization=Bearer token",
+		"webhook_max_delay": "50ms",
+	}
+	hooks, err := newWebhooks(config, hclog.NewNullLogger())
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name            string
+		statuses        []int
+		failurePolicy   string
+		expectedAllowed bool
+		expectedErr     bool
+		expectedCalls   int
+	}{
+		{name: "allowed", statuses: []int{http.StatusOK}, expectedAllowed: true, expectedCalls: 1},
+		{name: "refused", statuses: []int{http.StatusConflict}, expectedAllowed: false, expectedCalls: 1},
+		{name: "delayed", statuses: []int{http.StatusAccepted, http.StatusNoContent}, expectedAllowed: true, expectedCalls: 2},
+		{name: "delayed too long", statuses: []int{http.StatusAccepted}, expectedAllowed: false},
+		{name: "failed", statuses: []int{http.StatusInternalServerError}, expectedAllowed: true, expectedCalls: 1},
+		{name: "failed with abort", statuses: []int{http.StatusInternalServerError}, failurePolicy: failurePolicyAbort, expectedErr: true, expectedCalls: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			statuses, received = tc.statuses, nil
+			hooks.failurePolicy = failurePolicyContinue
+			if tc.failurePolicy != "" {
+				hooks.failurePolicy = tc.failurePolicy
+			}
+
+			allowed, err := hooks.ask(context.Background(), webhookEvent{Event: eventPreDelete, Pool: "workers", Server: webhookServer{ID: "abc"}})
+			if tc.expectedErr {
+				assert.Error(t, err, tc.name)
+			} else {
+				assert.NoError(t, err, tc.name)
+				assert.Equal(t, tc.expectedAllowed, allowed, tc.name)
+			}
+			if tc.expectedCalls > 0 {
+				assert.Len(t, received, tc.expectedCalls, tc.name)
+			}
+			assert.Equal(t, eventPreDelete, received[0].Event, tc.name)
+			assert.Equal(t, "abc", received[0].Server.ID, tc.name)
+		})
+	}
+
+	// events not selected aren't sent
+	config["webhook_events"] = "pre_delete"
+	hooks, err = newWebhooks(config, hclog.NewNullLogger())
+	assert.NoError(t, err)
+	received = nil
+	assert.NoError(t, hooks.notify(context.Background(), webhookEvent{Event: eventPostCreate}))
+	assert.Empty(t, received)
+
+	// no webhook allows everything
+	var noHooks *webhooks
+	allowed, err := noHooks.ask(context.Background(), webhookEvent{Event: eventPreCreate})
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	_, err = newWebhooks(map[string]string{"webhook_url": server.URL, "webhook_events": "pre_stop"}, hclog.NewNullLogger())
+	assert.Error(t, err)
+	_, err = newWebhooks(map[string]string{"webhook_url": server.URL, "webhook_failure_policy": "retry"}, hclog.NewNullLogger())
+	assert.Error(t, err)
+}
+
+func Test_PreScaleIn(t *testing.T) {
+	testCases := []struct {
+		name          string
+		refused       []string
+		strategy      string
+		count         int
+		expectedAsked []string
+		expectedDrain []string
+		expectedErr   string
+	}{
+		{
+			name:          "allowed",
+			count:         1,
+			expectedAsked: []string{"srv-3"},
+			expectedDrain: []string{"srv-3"},
+		},
+		{
+			name:          "refused node replaced",
+			refused:       []string{"srv-3"},
+			count:         1,
+			expectedAsked: []string{"srv-3", "srv-2"},
+			expectedDrain: []string{"srv-2"},
+		},
+		{
+			name:          "only a portion allowed",
+			refused:       []string{"srv-2", "srv-3"},
+			count:         2,
+			expectedAsked: []string{"srv-3", "srv-2", "srv-1"},
+			expectedDrain: []string{"srv-1"},
+		},
+		{
+			name:          "all refused",
+			refused:       []string{"srv-1", "srv-2", "srv-3"},
+			count:         1,
+			expectedAsked: []string{"srv-3", "srv-2", "srv-1"},
+			expectedErr:   "no nodes identified",
+		},
+		{
+			name:        "nodes can't be selected",
+			strategy:    "unknown",
+			count:       1,
+			expectedErr: "unsupported node selector strategy",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				lock  sync.Mutex
+				asked []string
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var event webhookEvent
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+				assert.Equal(t, eventPreDelete, event.Event)
+				assert.Equal(t, "node-"+event.Server.ID, event.NodeID)
+
+				lock.Lock()
+				asked = append(asked, event.Server.ID)
+				lock.Unlock()
+				if slices.Contains(tc.refused, event.Server.ID) {
+					w.WriteHeader(http.StatusConflict)
+				}
+			}))
+			defer server.Close()
+
+			hooks, err := newWebhooks(map[string]string{"webhook_url": server.URL}, hclog.NewNullLogger())
+			assert.NoError(t, err)
+			utils, _, drained := newTestClusterUtils(t, "srv-1", "srv-2", "srv-3")
+			p := &TargetPlugin{logger: hclog.NewNullLogger(), idMapper: true, clusterUtils: utils}
+			strategy := sdk.TargetNodeSelectorStrategyNewestCreateIndex
+			if tc.strategy != "" {
+				strategy = tc.strategy
+			}
+
+			ids, err := p.preScaleIn(context.Background(), map[string]string{
+				configKeyPoolName:                    "workers",
+				sdk.TargetConfigKeyClass:             "wrkr",
+				sdk.TargetConfigNodeSelectorStrategy: strategy,
+			}, []string{"srv-1", "srv-2", "srv-3"}, nil, tc.count, hooks, nil)
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr, tc.name)
+			} else {
+				assert.NoError(t, err, tc.name)
+				assert.Len(t, ids, len(tc.expectedDrain), tc.name)
+			}
+			assert.Equal(t, tc.expectedAsked, asked, tc.name)
+			assert.Equal(t, tc.expectedDrain, drained(), tc.name)
+		})
+	}
+}